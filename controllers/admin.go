@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"zeroshare-backend/middlewares"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// AdminListUsers pages through all users. Filters are q, which matches part of the email or name,
+// role and suspended, and the total before paging is sent in X-Total-Count.
+func AdminListUsers(c *fiber.Ctx, db *gorm.DB) error {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	query := db.Model(&structs.User{})
+	if search := c.Query("q"); search != "" {
+		pattern := "%" + escapeLike(search) + "%"
+		query = query.Where("email ILIKE ? OR name ILIKE ?", pattern, pattern)
+	}
+	if role := c.Query("role"); role != "" {
+		query = query.Where("role = ?", role)
+	}
+	if suspended := c.Query("suspended"); suspended != "" {
+		query = query.Where("suspended = ?", suspended == "true")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	users := []structs.User{}
+	if err := query.Order("email ASC").Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	c.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	return c.JSON(users)
+}
+
+func AdminGetUser(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	var user structs.User
+	if err := db.Where("id = ?", c.Params("id")).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	devices := []*structs.Device{}
+	if err := db.Where("user_id = ?", user.ID).Order("created ASC").Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if err := FillPresence(c.Context(), redisStore, devices); err != nil {
+		log.Println("Failed to load device presence:", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"user":    user,
+		"devices": devices,
+	})
+}
+
+// AdminUpdateUser changes a user's role, which reaches their token when it is next refreshed.
+// Admins listed in ADMIN_EMAILS can't be demoted here.
+func AdminUpdateUser(c *fiber.Ctx, db *gorm.DB) error {
+	body := new(structs.UpdateUserRequest)
+	c.BodyParser(body)
+	if body.Role != middlewares.RoleAdmin && body.Role != middlewares.RoleUser {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid role",
+		})
+	}
+
+	var user structs.User
+	if err := db.Where("id = ?", c.Params("id")).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if body.Role != middlewares.RoleAdmin && envAdmin(user) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User is an admin through ADMIN_EMAILS, remove their email from it to demote them",
+		})
+	}
+	user.Role = body.Role
+	if err := db.Model(&user).Update("role", user.Role).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(user)
+}
+
+// AdminSuspendUser locks a user out of the API, logs out their sessions and revokes their devices'
+// certs so they also drop off the mesh. Unsuspended users' devices have to sign new certs.
+func AdminSuspendUser(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	callerId, _ := GetFromToken(c, "ID")
+	if c.Params("id") == callerId {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot suspend yourself",
+		})
+	}
+
+	user, err := setSuspended(db, c.Params("id"), true)
+	if err != nil {
+		return suspendError(c, err)
+	}
+	if err := revokeSessions(db.Where("user_id = ?", user.ID)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	var devices []structs.Device
+	if err := db.Where("user_id = ?", user.ID).Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	for _, device := range devices {
+		if _, err := RevokeDeviceCertificates(db, redisStore, device.ID, "user suspended"); err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to revoke certificates",
+			})
+		}
+	}
+	return c.JSON(user)
+}
+
+func AdminUnsuspendUser(c *fiber.Ctx, db *gorm.DB) error {
+	user, err := setSuspended(db, c.Params("id"), false)
+	if err != nil {
+		return suspendError(c, err)
+	}
+	return c.JSON(user)
+}
+
+func setSuspended(db *gorm.DB, userId string, suspended bool) (structs.User, error) {
+	var user structs.User
+	if err := db.Where("id = ?", userId).First(&user).Error; err != nil {
+		return user, err
+	}
+	user.Suspended = suspended
+	return user, db.Model(&user).Update("suspended", suspended).Error
+}
+
+func suspendError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Database error",
+	})
+}
+
+// AdminListDevices pages through every user's devices. It takes ListDevices' parameters plus
+// user_id.
+func AdminListDevices(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	query := db.Model(&structs.Device{})
+	if userId := c.Query("user_id"); userId != "" {
+		query = query.Where("user_id = ?", userId)
+	}
+	return listDevices(c, redisStore, query)
+}
+
+func AdminGetDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	var device structs.Device
+	if err := db.Where("id = ?", c.Params("id")).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+	if err := FillPresence(c.Context(), redisStore, []*structs.Device{&device}); err != nil {
+		log.Println("Failed to load device presence:", err)
+	}
+	return c.JSON(device)
+}
+
+func AdminDeleteDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	var device structs.Device
+	if err := db.Where("id = ?", c.Params("id")).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+	return deleteDevice(c, db, redisStore, device)
+}
+
+// AdminRevokeDevice revokes a device's certs but keeps the device and its address
+func AdminRevokeDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	var device structs.Device
+	if err := db.Where("id = ?", c.Params("id")).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+	fingerprints, err := RevokeDeviceCertificates(db, redisStore, device.ID, "revoked by admin")
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke certificates",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"revoked": fingerprints,
+	})
+}
+
+func AdminIPPool(c *fiber.Ctx, db *gorm.DB) error {
+	status, err := IPPoolStatus(db)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(status)
+}
+
+// AdminIPAllocations pages through the allocated addresses in address order, with the device
+// holding each one
+func AdminIPAllocations(c *fiber.Ctx, db *gorm.DB) error {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	query := db.Model(&structs.IpAllocation{})
+	if userId := c.Query("user_id"); userId != "" {
+		query = query.Where("device_id IN (?)", db.Model(&structs.Device{}).Select("id").Where("user_id = ?", userId))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	var allocations []structs.IpAllocation
+	if err := query.Preload("Device").Order("ip_int ASC").Limit(limit).Offset(offset).Find(&allocations).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	response := make([]structs.IpAllocationResponse, len(allocations))
+	for i, allocation := range allocations {
+		response[i] = structs.IpAllocationResponse{
+			IpAddress:   allocation.IpAddress,
+			DeviceId:    allocation.DeviceId,
+			MachineName: allocation.Device.MachineName,
+			UserId:      allocation.Device.UserId,
+			Created:     allocation.Created,
+		}
+	}
+	c.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	return c.JSON(response)
+}
@@ -3,151 +3,56 @@ package controllers
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"os"
 	"time"
 	structs "zeroshare-backend/structs"
 
 	"github.com/gofiber/fiber/v2"
 	jtoken "github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"github.com/valyala/fasthttp"
 	otel "go.opentelemetry.io/otel"
 	attribute "go.opentelemetry.io/otel/attribute"
 	codes "go.opentelemetry.io/otel/codes"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	idToken "google.golang.org/api/idtoken"
 	"gorm.io/gorm"
 )
 
-func SetUpOAuth() *oauth2.Config {
-	oauthConf := &oauth2.Config{
-		ClientID:     os.Getenv("CLIENT_ID"),     //get google client id from .env file
-		ClientSecret: os.Getenv("CLIENT_SECRET"), //get google secret id from .env file
-		RedirectURL:  os.Getenv("REDIRECT_URL"),  //get redirect URL from .env file
-		Scopes: []string{
-			"https://www.googleapis.com/auth/userinfo.email",
-			"https://www.googleapis.com/auth/userinfo.profile",
-		},
-		Endpoint: google.Endpoint,
-	}
-	log.Println("Redirect URL: ", oauthConf.RedirectURL)
-	return oauthConf
-}
-
-func GetAuthData(c *fiber.Ctx, oauthConf *oauth2.Config, db *gorm.DB, redisStore *redis.Client) error {
-	code := c.Query("code")
-	if code == "" {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to exchange token: ")
-	}
-	token, err := oauthConf.Exchange(context.Background(), code) //get token
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to exchange token: " + err.Error())
-	}
-	client := oauthConf.Client(context.Background(), token)                      //set client for getting user info like email, name, etc.
-	response, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo") //get user info
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to get user info: " + err.Error())
-	}
-
-	defer response.Body.Close()
-	var user structs.User //user variable
-
-	bytes, err := io.ReadAll(response.Body) //reading response body from client
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error reading response body: " + err.Error())
-	}
-	err = json.Unmarshal(bytes, &user) //unmarshal user info
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error unmarshal json body " + err.Error())
-	}
-
-	db.Where(structs.User{Email: user.Email}).FirstOrCreate(&user)
+// createToken signs an access token for the session and adds a new refresh token to it
+func createToken(db *gorm.DB, user structs.User, session structs.Session) (structs.TokenResponse, error) {
+	exp := time.Now().Add(accessTokenTTL)
 
-	log.Printf("user data is %v", user)
-
-	sessionToken := c.Query("state")
-
-	log.Printf("Sending publish message to %s -> %s", sessionToken, user.GoogleID)
-	tokenResponse := createToken(user)
-
-	log.Printf("token response is %v", tokenResponse)
-
-	jsonData, err := json.Marshal(tokenResponse)
-	if err != nil {
-		log.Fatalf("Error marshalling JSON: %v", err)
-	}
-	redisStore.Publish(context.Background(), sessionToken, jsonData)
-
-	return c.Status(200).SendString("You may close this window")
-}
-
-func createToken(user structs.User) structs.TokenResponse {
-	exp := time.Now().Add(time.Hour * 72)
-
-	// Create the JWT claims, which includes the user ID and expiry time
+	// Create the JWT claims, which includes the user ID, session and expiry time
 	claims := jtoken.MapClaims{
 		"ID":    user.ID,
+		"sid":   session.ID,
 		"name":  user.Name,
 		"email": user.Email,
+		"role":  userRole(user),
 		"exp":   exp.Unix(),
 	}
-	// Create token
-	jwtToken := jtoken.NewWithClaims(jtoken.SigningMethodHS256, claims)
-	// Generate encoded token and send it as response.
-	token, err := jwtToken.SignedString([]byte(os.Getenv("AUTH_SECRET")))
-	if err != nil {
-		log.Fatal(err)
+	// Informational only, handlers check membership against the database
+	if member, err := orgMembership(db, user.ID); err == nil {
+		claims["org_id"] = member.OrganizationId
+		claims["org_role"] = member.Role
 	}
-
-	// Set expiration for refresh token (longer-lived)
-	refreshExp := time.Now().Add(time.Hour * 24 * 7)
-
-	// Create the refresh token claims
-	refreshClaims := jtoken.MapClaims{
-		"ID":  user.ID,
-		"exp": refreshExp.Unix(),
-	}
-
-	// Create refresh token
-	jwtRefreshToken := jtoken.NewWithClaims(jtoken.SigningMethodHS256, refreshClaims)
-	refreshToken, err := jwtRefreshToken.SignedString([]byte(os.Getenv("AUTH_SECRET")))
+	// Sign with the keyring's active key
+	token, err := signJWT(claims)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	return structs.TokenResponse{
-		AuthToken:   token,
-		RefresToken: refreshToken, // You need to provide a value for RefresToken
+		return structs.TokenResponse{}, err
 	}
-}
 
-func GetAuthDataFromGooglePayload(token string, db *gorm.DB) (structs.TokenResponse, error) {
-	payload, err := idToken.Validate(context.Background(), token, os.Getenv("CLIENT_ID"))
+	// Refresh tokens are opaque, only their hash is stored with the session
+	refreshToken, err := storeRefreshToken(db, session)
 	if err != nil {
-		log.Println(err)
 		return structs.TokenResponse{}, err
 	}
 
-	user := structs.User{
-		Email:         payload.Claims["email"].(string),
-		FamilyName:    payload.Claims["family_name"].(string),
-		GivenName:     payload.Claims["given_name"].(string),
-		Locale:        "",
-		Name:          payload.Claims["name"].(string),
-		Picture:       payload.Claims["picture"].(string),
-		VerifiedEmail: payload.Claims["email_verified"].(bool),
-	}
-
-	db.Where(structs.User{Email: user.Email}).FirstOrCreate(&user)
-
-	return createToken(user), nil
+	return structs.TokenResponse{
+		AuthToken:   token,
+		RefresToken: refreshToken,
+	}, nil
 }
 
 func SSE(c *fiber.Ctx, redisStore *redis.Client, sessionToken string) error {
@@ -174,6 +79,13 @@ func SSE(c *fiber.Ctx, redisStore *redis.Client, sessionToken string) error {
 	c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
 
 		defer subscriber.Close()
+		// Tokens published before the subscription started are kept with the login session
+		if tokens, ok := takeLoginSessionTokens(ctx, redisStore, sessionToken); ok {
+			fmt.Fprintf(w, "data: %s\n\n", tokens)
+			w.WriteString("event: complete\ndata: Authentication completed\n\n")
+			w.Flush()
+			return
+		}
 		for {
 			msgCtx, msgSpan := tracer.Start(ctx, "SSE.ReceiveMessage")
 
@@ -210,6 +122,8 @@ func SSE(c *fiber.Ctx, redisStore *redis.Client, sessionToken string) error {
 				log.Printf("Error sending completion event: %v", err)
 			}
 			w.Flush()
+			// Single use, the session ends once its tokens are delivered
+			redisStore.Del(ctx, loginSessionKey(sessionToken))
 			msgSpan.End()
 			return
 		}
@@ -227,13 +141,7 @@ func GetFromToken(c *fiber.Ctx, key string) (interface{}, error) {
 	}
 
 	// Parse the token
-	token, _ := jtoken.Parse(tokenString, func(token *jtoken.Token) (interface{}, error) {
-		// Ensure that the token's signing method is what we expect
-		if _, ok := token.Method.(*jtoken.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return os.Getenv("AUTH_SECRET"), nil
-	})
+	token, _ := jtoken.Parse(tokenString, JWTKeyfunc)
 
 	// Extract the claims from the token (assuming it's a map of claims)
 	claims, ok := token.Claims.(jtoken.MapClaims)
@@ -245,44 +153,39 @@ func GetFromToken(c *fiber.Ctx, key string) (interface{}, error) {
 	return claims[key], nil
 }
 
+// RefreshToken swaps a refresh token for a new pair, the old one stops working
 func RefreshToken(c *fiber.Ctx, db *gorm.DB, refreshToken string) error {
-	// Validate and parse the refresh token
-	token, err := jtoken.Parse(refreshToken, func(token *jtoken.Token) (interface{}, error) {
-		return []byte(os.Getenv("AUTH_SECRET")), nil
-	})
-	if err != nil || !token.Valid {
+	session, err := rotateRefreshToken(db, refreshToken)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		log.Printf("Refresh token reused, revoked session %s", session.ID)
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid refresh token",
+			"error": "Refresh token has already been used",
 		})
 	}
-
-	// Extract claims
-	claims, ok := token.Claims.(jtoken.MapClaims)
-	if !ok || claims["ID"] == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid token claims",
-		})
-	}
-
-	// Generate new tokens
-	userID, err := uuid.Parse(claims["ID"].(string))
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid user ID",
+			"error": "Invalid refresh token",
 		})
 	}
+
 	var user structs.User
-	err = db.Where(structs.User{ID: userID}).First(&user).Error
+	err = db.Where(structs.User{ID: session.UserId}).First(&user).Error
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "User not found",
 		})
 	}
-	if user == (structs.User{}) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "User not found",
+	if user.Suspended {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Account suspended",
 		})
 	}
 
-	return c.JSON(createToken(user))
+	tokens, err := createToken(db, user, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create tokens",
+		})
+	}
+	return c.JSON(tokens)
 }
@@ -0,0 +1,362 @@
+package controllers
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/slackhq/nebula/cert"
+	"gorm.io/gorm"
+)
+
+const (
+	CAStatusActive   = "active"
+	CAStatusRetiring = "retiring"
+	CAStatusRetired  = "retired"
+)
+
+const (
+	lighthouseCrtPath = "./certs/lighthouse.crt"
+	lighthouseKeyPath = "./certs/lighthouse.key"
+)
+
+var (
+	ErrRotationInProgress = errors.New("a CA rotation is already in progress")
+	ErrCANotFound         = errors.New("CA not found")
+)
+
+// Serialises changes to the CA files within this process
+var caMu sync.Mutex
+
+// registerActiveCA records the CA on disk as the active one the first time the backend sees it
+func registerActiveCA(db *gorm.DB) error {
+	caCrt, err := os.ReadFile(caCrtPath)
+	if err != nil {
+		return err
+	}
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(caCrt)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := nc.Sha256Sum()
+	if err != nil {
+		return err
+	}
+
+	var active structs.CertificateAuthority
+	err = db.Where("status = ?", CAStatusActive).First(&active).Error
+	if err == nil {
+		if active.Fingerprint != fingerprint {
+			log.Printf("registerActiveCA: CA %s on disk is not the active CA %s", fingerprint, active.Fingerprint)
+		}
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	pem, err := nc.MarshalToPEM()
+	if err != nil {
+		return err
+	}
+	return db.Create(&structs.CertificateAuthority{
+		Fingerprint: fingerprint,
+		Name:        nc.Details.Name,
+		Cert:        string(pem),
+		Status:      CAStatusActive,
+		NotAfter:    nc.Details.NotAfter.Unix(),
+	}).Error
+}
+
+func ListCAs(db *gorm.DB) ([]structs.CertificateAuthority, error) {
+	cas := []structs.CertificateAuthority{}
+	err := db.Order("created DESC").Find(&cas).Error
+	return cas, err
+}
+
+// RotateCA creates a new CA that signs every cert from now on. The old CA stays in the ca_cert
+// bundle handed to devices and the lighthouse until the overlap has passed, so devices have time
+// to renew onto the new one before it is retired.
+func RotateCA(db *gorm.DB, overlap time.Duration) (structs.CertificateAuthority, error) {
+	caMu.Lock()
+	defer caMu.Unlock()
+
+	var retiring int64
+	if err := db.Model(&structs.CertificateAuthority{}).Where("status = ?", CAStatusRetiring).Count(&retiring).Error; err != nil {
+		return structs.CertificateAuthority{}, err
+	}
+	if retiring > 0 {
+		return structs.CertificateAuthority{}, ErrRotationInProgress
+	}
+
+	var active structs.CertificateAuthority
+	if err := db.Where("status = ?", CAStatusActive).First(&active).Error; err != nil {
+		return structs.CertificateAuthority{}, err
+	}
+
+	// Kept to put back if the new CA's files can't be written
+	previous, err := caKeyStore.Signer()
+	if err != nil {
+		return structs.CertificateAuthority{}, err
+	}
+
+	caCrt, caKey, err := generateCA(active.Name, caDuration)
+	if err != nil {
+		return structs.CertificateAuthority{}, err
+	}
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(caCrt)
+	if err != nil {
+		return structs.CertificateAuthority{}, err
+	}
+	fingerprint, err := nc.Sha256Sum()
+	if err != nil {
+		return structs.CertificateAuthority{}, err
+	}
+
+	newCA := structs.CertificateAuthority{
+		Fingerprint: fingerprint,
+		Name:        nc.Details.Name,
+		Cert:        string(caCrt),
+		Status:      CAStatusActive,
+		NotAfter:    nc.Details.NotAfter.Unix(),
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&structs.CertificateAuthority{}).
+			Where("fingerprint = ?", active.Fingerprint).
+			Updates(map[string]interface{}{"status": CAStatusRetiring, "retire_at": time.Now().Add(overlap).Unix()}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&newCA).Error
+	})
+	if err != nil {
+		return structs.CertificateAuthority{}, err
+	}
+
+	// Files are only replaced once the records are committed, a failure puts the old key and
+	// records back so the key always matches the active CA
+	if err := caKeyStore.Store(cert.Curve_CURVE25519, caKey); err != nil {
+		return structs.CertificateAuthority{}, undoRotation(db, active, newCA, err)
+	}
+	if err := writeCABundle(db); err != nil {
+		curve, key, restoreErr := signerKey(previous)
+		if restoreErr == nil {
+			restoreErr = caKeyStore.Store(curve, key)
+		}
+		if restoreErr != nil {
+			log.Printf("RotateCA: failed to restore the previous CA key: %v", restoreErr)
+		}
+		return structs.CertificateAuthority{}, undoRotation(db, active, newCA, err)
+	}
+
+	log.Printf("Rotated CA %s -> %s, old CA retires in %s", active.Fingerprint, fingerprint, overlap)
+	return newCA, nil
+}
+
+// undoRotation makes the previous CA active again after its replacement couldn't be put in place,
+// and returns the error that stopped the rotation
+func undoRotation(db *gorm.DB, previous structs.CertificateAuthority, replacement structs.CertificateAuthority, cause error) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&structs.CertificateAuthority{}, "fingerprint = ?", replacement.Fingerprint).Error; err != nil {
+			return err
+		}
+		return tx.Model(&structs.CertificateAuthority{}).
+			Where("fingerprint = ?", previous.Fingerprint).
+			Updates(map[string]interface{}{"status": CAStatusActive, "retire_at": previous.RetireAt}).Error
+	})
+	if err != nil {
+		log.Printf("RotateCA: failed to undo rotation to %s: %v", replacement.Fingerprint, err)
+	}
+	return cause
+}
+
+// RetireCA stops trusting a retiring CA. Devices that haven't renewed by now lose access
+// until they sign a new cert.
+func RetireCA(db *gorm.DB, fingerprint string) error {
+	caMu.Lock()
+	defer caMu.Unlock()
+
+	result := db.Model(&structs.CertificateAuthority{}).
+		Where("fingerprint = ? AND status = ?", fingerprint, CAStatusRetiring).
+		Updates(map[string]interface{}{"status": CAStatusRetired, "retire_at": time.Now().Unix()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCANotFound
+	}
+
+	if err := writeCABundle(db); err != nil {
+		return err
+	}
+	log.Printf("Retired CA %s", fingerprint)
+
+	return resignLighthouse()
+}
+
+// retireDueCAs retires every CA whose overlap window has passed
+func retireDueCAs(db *gorm.DB) error {
+	var due []structs.CertificateAuthority
+	if err := db.Where("status = ? AND retire_at <= ?", CAStatusRetiring, time.Now().Unix()).Find(&due).Error; err != nil {
+		return err
+	}
+	for _, ca := range due {
+		if err := RetireCA(db, ca.Fingerprint); err != nil && !errors.Is(err, ErrCANotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCABundle writes every trusted CA to ca.crt, active first since that's the one signing
+func writeCABundle(db *gorm.DB) error {
+	var active structs.CertificateAuthority
+	if err := db.Where("status = ?", CAStatusActive).First(&active).Error; err != nil {
+		return err
+	}
+	var retiring []structs.CertificateAuthority
+	if err := db.Where("status = ?", CAStatusRetiring).Order("created DESC").Find(&retiring).Error; err != nil {
+		return err
+	}
+
+	bundle := []string{strings.TrimSpace(active.Cert)}
+	for _, ca := range retiring {
+		bundle = append(bundle, strings.TrimSpace(ca.Cert))
+	}
+	return writeFileAtomic(caCrtPath, []byte(strings.Join(bundle, "\n")+"\n"), 0600)
+}
+
+// resignLighthouse moves the lighthouse cert onto the active CA once the old one is no longer trusted.
+// start-lighthouse.sh reloads the lighthouse once the cert changes.
+func resignLighthouse() error {
+	lighthouseCrt, err := os.ReadFile(lighthouseCrtPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lighthouse, _, err := cert.UnmarshalNebulaCertificateFromPEM(lighthouseCrt)
+	if err != nil {
+		return err
+	}
+
+	caCrt, err := os.ReadFile(caCrtPath)
+	if err != nil {
+		return err
+	}
+	caSigner, err := caKeyStore.Signer()
+	if err != nil {
+		return err
+	}
+	ca, _, err := cert.UnmarshalNebulaCertificateFromPEM(caCrt)
+	if err != nil {
+		return err
+	}
+	caFingerprint, err := ca.Sha256Sum()
+	if err != nil {
+		return err
+	}
+	if lighthouse.Details.Issuer == caFingerprint || len(lighthouse.Details.Ips) == 0 {
+		return nil
+	}
+
+	publicKey := cert.MarshalPublicKey(lighthouse.Details.Curve, lighthouse.Details.PublicKey)
+	resigned, err := signHostCert(caCrt, caSigner, publicKey, lighthouse.Details.Name, lighthouse.Details.Ips[0], lighthouse.Details.Groups, 0)
+	if err != nil {
+		return err
+	}
+	pem, err := resigned.MarshalToPEM()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(lighthouseCrtPath, pem, 0600); err != nil {
+		return err
+	}
+
+	log.Printf("Re-signed lighthouse cert with CA %s", caFingerprint)
+	return nil
+}
+
+// issueLighthouseCert signs a cert for the bundled lighthouse, the first one in the network config,
+// unless it already has one for that ip. The lighthouse container waits for it, so the CA key never
+// has to leave whichever key backend holds it.
+func issueLighthouseCert() error {
+	if len(networkConfig.Lighthouses) == 0 {
+		return errors.New("no lighthouse configured")
+	}
+	ip := net.ParseIP(networkConfig.Lighthouses[0].Ip).To4()
+	if ip == nil {
+		return errors.New("invalid lighthouse ip " + networkConfig.Lighthouses[0].Ip)
+	}
+	if existing, err := os.ReadFile(lighthouseCrtPath); err == nil {
+		lighthouse, _, err := cert.UnmarshalNebulaCertificateFromPEM(existing)
+		if err == nil && len(lighthouse.Details.Ips) > 0 && lighthouse.Details.Ips[0].IP.Equal(ip) {
+			return nil
+		}
+		log.Printf("Lighthouse cert doesn't match %s from the network config, issuing a new one", ip)
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	caCrt, err := os.ReadFile(caCrtPath)
+	if err != nil {
+		return err
+	}
+	caSigner, err := caKeyStore.Signer()
+	if err != nil {
+		return err
+	}
+	publicKey := cert.MarshalX25519PublicKey(key.PublicKey().Bytes())
+	ipNet := &net.IPNet{IP: ip, Mask: networkConfig.Network().Mask}
+	lighthouse, err := signHostCert(caCrt, caSigner, publicKey, "lighthouse", ipNet, []string{"lighthouse"}, 0)
+	if err != nil {
+		return err
+	}
+	pem, err := lighthouse.MarshalToPEM()
+	if err != nil {
+		return err
+	}
+
+	// The key goes first, the lighthouse starts as soon as the cert shows up
+	if err := writeFileAtomic(lighthouseKeyPath, cert.MarshalX25519PrivateKey(key.Bytes()), 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(lighthouseCrtPath, pem, 0600); err != nil {
+		return err
+	}
+	log.Printf("Issued lighthouse cert for %s", ipNet)
+	return nil
+}
+
+// writeFileAtomic replaces path through a rename so readers never see a half written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+var ErrKeyStoreReadOnly = errors.New("CA key backend can't store new keys")
+
+// CAKeyStore keeps the CA private key out of the signing path, which only ever gets a crypto.Signer.
+type CAKeyStore interface {
+	// Signer returns a signer for the active CA key
+	Signer() (crypto.Signer, error)
+	// Store replaces the active CA key, e.g. after a rotation
+	Store(curve cert.Curve, key []byte) error
+}
+
+var caKeyStore CAKeyStore
+
+// SetCAKeyStore swaps the CA key backend before InitNebula runs, e.g. for a PKCS#11 or KMS
+// signer or a software stand-in in tests. Hardware backends are wired in main with
+// SetCAKeyStore(NewSignerKeyStore(signer)) and NEBULA_CA_KEY_BACKEND=signer.
+func SetCAKeyStore(store CAKeyStore) {
+	caKeyStore = store
+}
+
+// Lighter than nebula-cert's 2GiB default so startup stays quick, still readable by nebula-cert
+var caKeyArgon2Params = cert.NewArgon2Parameters(64*1024, 4, 3)
+
+// caKeyStoreFromEnv picks the backend named by NEBULA_CA_KEY_BACKEND:
+//   - "file" (default): ./certs/ca.key, encrypted with NEBULA_CA_PASSPHRASE, which is required
+//   - "file-plaintext": ./certs/ca.key unencrypted, only for setups that protect the disk otherwise
+//   - "env": the PEM in NEBULA_CA_KEY, or the secret mounted at NEBULA_CA_KEY_FILE
+//   - "signer": a PKCS#11 or KMS signer set with SetCAKeyStore, InitNebula only gets here without one
+func caKeyStoreFromEnv() (CAKeyStore, error) {
+	passphrase, err := caKeyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend := os.Getenv("NEBULA_CA_KEY_BACKEND"); backend {
+	case "", "file":
+		if len(passphrase) == 0 {
+			return nil, errors.New("NEBULA_CA_PASSPHRASE or NEBULA_CA_PASSPHRASE_FILE must be set for the file CA key backend, set NEBULA_CA_KEY_BACKEND=file-plaintext to store the key unencrypted")
+		}
+		return &fileKeyStore{path: caKeyPath, passphrase: passphrase}, nil
+	case "file-plaintext":
+		log.Printf("The CA key at %s is stored unencrypted", caKeyPath)
+		return &fileKeyStore{path: caKeyPath}, nil
+	case "env":
+		return &envKeyStore{passphrase: passphrase}, nil
+	case "signer":
+		return nil, errors.New("NEBULA_CA_KEY_BACKEND=signer needs a signer set with SetCAKeyStore before InitNebula")
+	default:
+		return nil, fmt.Errorf("unknown NEBULA_CA_KEY_BACKEND %q", backend)
+	}
+}
+
+func caKeyPassphrase() ([]byte, error) {
+	if path := os.Getenv("NEBULA_CA_PASSPHRASE_FILE"); path != "" {
+		passphrase, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA passphrase: %v", err)
+		}
+		return []byte(strings.TrimSpace(string(passphrase))), nil
+	}
+	return []byte(os.Getenv("NEBULA_CA_PASSPHRASE")), nil
+}
+
+// fileKeyStore keeps the key in a PEM file, encrypted the same way `nebula-cert ca -encrypt` does
+// whenever a passphrase is configured.
+type fileKeyStore struct {
+	path       string
+	passphrase []byte
+
+	mu     sync.Mutex
+	signer crypto.Signer
+}
+
+func (f *fileKeyStore) Signer() (crypto.Signer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.signer != nil {
+		return f.signer, nil
+	}
+
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA key: %v", err)
+	}
+	curve, key, encrypted, err := unmarshalCAKey(raw, f.passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys written by nebula-cert or older backends are plaintext, encrypt them in place
+	if !encrypted && len(f.passphrase) > 0 {
+		if err := f.write(curve, key); err != nil {
+			return nil, err
+		}
+		log.Printf("Encrypted CA key at %s", f.path)
+	}
+
+	f.signer, err = rawKeySigner(curve, key)
+	return f.signer, err
+}
+
+func (f *fileKeyStore) Store(curve cert.Curve, key []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.write(curve, key); err != nil {
+		return err
+	}
+	signer, err := rawKeySigner(curve, key)
+	if err != nil {
+		return err
+	}
+	f.signer = signer
+	return nil
+}
+
+func (f *fileKeyStore) write(curve cert.Curve, key []byte) error {
+	pem := cert.MarshalSigningPrivateKey(curve, key)
+	if len(f.passphrase) > 0 {
+		var err error
+		pem, err = cert.EncryptAndMarshalSigningPrivateKey(curve, key, f.passphrase, caKeyArgon2Params)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt CA key: %v", err)
+		}
+	}
+	return writeFileAtomic(f.path, pem, 0600)
+}
+
+// envKeyStore reads the key from the environment or a mounted secret. It can't be written to,
+// so rotating the CA means updating the secret.
+type envKeyStore struct {
+	passphrase []byte
+
+	mu     sync.Mutex
+	signer crypto.Signer
+}
+
+func (e *envKeyStore) Signer() (crypto.Signer, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.signer != nil {
+		return e.signer, nil
+	}
+
+	raw := []byte(os.Getenv("NEBULA_CA_KEY"))
+	if path := os.Getenv("NEBULA_CA_KEY_FILE"); path != "" {
+		var err error
+		raw, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA key secret: %v", err)
+		}
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("NEBULA_CA_KEY or NEBULA_CA_KEY_FILE must be set for the env CA key backend")
+	}
+
+	curve, key, _, err := unmarshalCAKey(raw, e.passphrase)
+	if err != nil {
+		return nil, err
+	}
+	e.signer, err = rawKeySigner(curve, key)
+	return e.signer, err
+}
+
+func (e *envKeyStore) Store(curve cert.Curve, key []byte) error {
+	return ErrKeyStoreReadOnly
+}
+
+// signerKeyStore wraps any crypto.Signer, such as a PKCS#11 token or cloud KMS key, where the
+// private key never leaves the device.
+type signerKeyStore struct {
+	signer crypto.Signer
+}
+
+func NewSignerKeyStore(signer crypto.Signer) CAKeyStore {
+	return &signerKeyStore{signer: signer}
+}
+
+func (s *signerKeyStore) Signer() (crypto.Signer, error) {
+	return s.signer, nil
+}
+
+func (s *signerKeyStore) Store(curve cert.Curve, key []byte) error {
+	return ErrKeyStoreReadOnly
+}
+
+// signerKey returns the raw Nebula key behind a signer from rawKeySigner, so a replaced key can be
+// stored again
+func signerKey(signer crypto.Signer) (cert.Curve, []byte, error) {
+	switch key := signer.(type) {
+	case ed25519.PrivateKey:
+		return cert.Curve_CURVE25519, key, nil
+	case *ecdsa.PrivateKey:
+		return cert.Curve_P256, key.D.FillBytes(make([]byte, 32)), nil
+	default:
+		return 0, nil, fmt.Errorf("CA key of type %T can't be exported", signer)
+	}
+}
+
+// unmarshalCAKey decodes a plaintext or passphrase encrypted Nebula signing key
+func unmarshalCAKey(raw []byte, passphrase []byte) (cert.Curve, []byte, bool, error) {
+	key, _, curve, err := cert.UnmarshalSigningPrivateKey(raw)
+	if errors.Is(err, cert.ErrPrivateKeyEncrypted) {
+		if len(passphrase) == 0 {
+			return curve, nil, true, fmt.Errorf("CA key is encrypted, set NEBULA_CA_PASSPHRASE")
+		}
+		curve, key, _, err = cert.DecryptAndUnmarshalSigningPrivateKey(passphrase, raw)
+		if err != nil {
+			return curve, nil, true, fmt.Errorf("failed to decrypt CA key: %v", err)
+		}
+		return curve, key, true, nil
+	}
+	if err != nil {
+		return curve, nil, false, fmt.Errorf("error while parsing ca-key: %v", err)
+	}
+	return curve, key, false, nil
+}
+
+// rawKeySigner turns raw Nebula key bytes into the matching crypto.Signer
+func rawKeySigner(curve cert.Curve, key []byte) (crypto.Signer, error) {
+	switch curve {
+	case cert.Curve_CURVE25519:
+		return ed25519.PrivateKey(key), nil
+	case cert.Curve_P256:
+		signer := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256()},
+			D:         new(big.Int).SetBytes(key),
+		}
+		signer.X, signer.Y = signer.Curve.ScalarBaseMult(key)
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("invalid curve: %v", curve)
+	}
+}
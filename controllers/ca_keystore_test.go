@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFileKeyStore tests that the file backend encrypts keys at rest and still signs with them
+func TestFileKeyStore(t *testing.T) {
+	caCrt, caKey, err := generateCA("ZeroShare, Inc", caDuration)
+	assert.NoError(t, err)
+
+	ip, ipNet, _ := net.ParseCIDR("42.0.0.2/8")
+	ipNet.IP = ip.To4()
+
+	t.Run("stores encrypted keys", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ca.key")
+		store := &fileKeyStore{path: path, passphrase: []byte("hunter2")}
+		assert.NoError(t, store.Store(cert.Curve_CURVE25519, caKey))
+
+		raw, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.True(t, strings.Contains(string(raw), "ENCRYPTED"))
+
+		// A fresh store has to decrypt the file rather than use the cached signer
+		signer, err := (&fileKeyStore{path: path, passphrase: []byte("hunter2")}).Signer()
+		assert.NoError(t, err)
+		_, err = signHostCert(caCrt, signer, newHostPublicKey(t), "host.neb.test", ipNet, []string{}, 0)
+		assert.NoError(t, err)
+
+		_, err = (&fileKeyStore{path: path, passphrase: []byte("wrong")}).Signer()
+		assert.Error(t, err)
+		_, err = (&fileKeyStore{path: path}).Signer()
+		assert.Error(t, err)
+	})
+
+	t.Run("encrypts plaintext keys in place", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ca.key")
+		assert.NoError(t, os.WriteFile(path, cert.MarshalSigningPrivateKey(cert.Curve_CURVE25519, caKey), 0600))
+
+		_, err := (&fileKeyStore{path: path, passphrase: []byte("hunter2")}).Signer()
+		assert.NoError(t, err)
+
+		raw, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		_, _, _, err = cert.UnmarshalSigningPrivateKey(raw)
+		assert.ErrorIs(t, err, cert.ErrPrivateKeyEncrypted)
+	})
+
+	t.Run("signer backends are read only", func(t *testing.T) {
+		store := NewSignerKeyStore(caKey)
+		assert.ErrorIs(t, store.Store(cert.Curve_CURVE25519, caKey), ErrKeyStoreReadOnly)
+
+		signer, err := store.Signer()
+		assert.NoError(t, err)
+		_, err = signHostCert(caCrt, signer, newHostPublicKey(t), "host.neb.test", ipNet, []string{}, 0)
+		assert.NoError(t, err)
+	})
+}
+
+// TestSignerKey tests that keys can be read back out of their signers to be stored again
+func TestSignerKey(t *testing.T) {
+	_, caKey, err := generateCA("ZeroShare, Inc", caDuration)
+	assert.NoError(t, err)
+
+	signer, err := rawKeySigner(cert.Curve_CURVE25519, caKey)
+	assert.NoError(t, err)
+	curve, key, err := signerKey(signer)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Curve_CURVE25519, curve)
+	assert.Equal(t, []byte(caKey), key)
+
+	p256Key := make([]byte, 32)
+	p256Key[31] = 7
+	signer, err = rawKeySigner(cert.Curve_P256, p256Key)
+	assert.NoError(t, err)
+	curve, key, err = signerKey(signer)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Curve_P256, curve)
+	assert.Equal(t, p256Key, key)
+}
+
+// TestCAKeyStoreFromEnv tests that the file backend won't keep the CA key unencrypted unless told to
+func TestCAKeyStoreFromEnv(t *testing.T) {
+	t.Setenv("NEBULA_CA_PASSPHRASE_FILE", "")
+
+	tests := []struct {
+		name       string
+		backend    string
+		passphrase string
+		plaintext  bool
+		err        bool
+	}{
+		{name: "file with passphrase", passphrase: "hunter2"},
+		{name: "file without passphrase", err: true},
+		{name: "explicit plaintext", backend: "file-plaintext", plaintext: true},
+		{name: "signer without SetCAKeyStore", backend: "signer", err: true},
+		{name: "unknown backend", backend: "vault", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NEBULA_CA_KEY_BACKEND", tt.backend)
+			t.Setenv("NEBULA_CA_PASSPHRASE", tt.passphrase)
+
+			store, err := caKeyStoreFromEnv()
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			fileStore, ok := store.(*fileKeyStore)
+			assert.True(t, ok)
+			assert.Equal(t, tt.plaintext, len(fileStore.passphrase) == 0)
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Statuses of a contact. Either side can block, only the addressee can accept or reject.
+const (
+	ContactStatusPending  = "pending"
+	ContactStatusAccepted = "accepted"
+	ContactStatusRejected = "rejected"
+	ContactStatusBlocked  = "blocked"
+)
+
+// tokenUserId returns the ID of the user the request's token was issued to
+func tokenUserId(c *fiber.Ctx) (uuid.UUID, error) {
+	userId, err := GetFromToken(c, "ID")
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(fmt.Sprint(userId))
+}
+
+// otherParty returns the user on the other side of the contact from userId
+func otherParty(contact structs.Contact, userId uuid.UUID) uuid.UUID {
+	if contact.RequesterId == userId {
+		return contact.AddresseeId
+	}
+	return contact.RequesterId
+}
+
+func contactResponse(contact structs.Contact, userId uuid.UUID) structs.ContactResponse {
+	other := contact.Requester
+	if contact.RequesterId == userId {
+		other = contact.Addressee
+	}
+	return structs.ContactResponse{
+		ID:       contact.ID,
+		Status:   contact.Status,
+		Incoming: contact.AddresseeId == userId,
+		User: structs.ContactUser{
+			ID:      other.ID,
+			Name:    other.Name,
+			Email:   other.Email,
+			Picture: other.Picture,
+		},
+		Created: contact.Created,
+	}
+}
+
+// visibleContacts scopes a query to the contacts userId is part of. A contact the other side
+// has blocked, or an invite they rejected, looks to the caller as if it doesn't exist.
+func visibleContacts(db *gorm.DB, userId uuid.UUID) *gorm.DB {
+	return db.Where("(requester_id = ? OR addressee_id = ?)", userId, userId).
+		Where("(status <> ? OR blocked_by = ?)", ContactStatusBlocked, userId).
+		Where("(status <> ? OR addressee_id = ?)", ContactStatusRejected, userId)
+}
+
+// areContacts reports whether the two users have an accepted contact between them
+func areContacts(db *gorm.DB, userId interface{}, otherId interface{}) (bool, error) {
+	var count int64
+	err := db.Model(&structs.Contact{}).
+		Where("status = ?", ContactStatusAccepted).
+		Where("(requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)",
+			userId, otherId, otherId, userId).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// contactUserIds returns the users userId has accepted contacts with
+func contactUserIds(db *gorm.DB, userId uuid.UUID) ([]uuid.UUID, error) {
+	var contacts []structs.Contact
+	err := db.Where("status = ? AND (requester_id = ? OR addressee_id = ?)", ContactStatusAccepted, userId, userId).
+		Find(&contacts).Error
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uuid.UUID, len(contacts))
+	for i, contact := range contacts {
+		ids[i] = otherParty(contact, userId)
+	}
+	return ids, nil
+}
+
+// PeerView strips a device down to what other users, its owner's contacts and organization, get
+// to see when it sends them something. device_id is left out since it vouches for new devices
+// of the owner.
+func PeerView(device structs.Device) structs.Device {
+	return structs.Device{
+		ID:          device.ID,
+		MachineName: device.MachineName,
+		Platform:    device.Platform,
+		IpAddress:   device.IpAddress,
+		Status:      device.Status,
+		UserId:      device.UserId,
+	}
+}
+
+// sharedDevices lists devices the way other users get to discover them
+func sharedDevices(devices []*structs.Device) []structs.SharedDevice {
+	shared := make([]structs.SharedDevice, len(devices))
+	for i, device := range devices {
+		shared[i] = structs.SharedDevice{
+			ID:          device.ID,
+			UserId:      device.UserId,
+			MachineName: device.MachineName,
+			Platform:    device.Platform,
+			Online:      device.Online,
+			LastSeen:    device.LastSeen,
+		}
+	}
+	return shared
+}
+
+// notifyUser queues a backend event for every approved device of the user
+func notifyUser(db *gorm.DB, redisStore *redis.Client, userId uuid.UUID, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	var deviceIds []uuid.UUID
+	err = db.Model(&structs.Device{}).
+		Where("user_id = ? AND status = ?", userId, DeviceStatusApproved).
+		Pluck("id", &deviceIds).Error
+	if err != nil {
+		return err
+	}
+	for _, deviceId := range deviceIds {
+		response := structs.SSEResponse{Type: eventType, Data: data}
+		if err := DeliverToDevice(context.Background(), redisStore, deviceId.String(), &response); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyContactChange tells both sides their contacts changed. Their devices pick up the new
+// firewall, which lets in accepted contacts' devices, on their next cert renewal.
+func notifyContactChange(db *gorm.DB, redisStore *redis.Client, contact structs.Contact, eventType string) {
+	for _, userId := range []uuid.UUID{contact.RequesterId, contact.AddresseeId} {
+		if err := notifyUser(db, redisStore, userId, eventType, contactResponse(contact, userId)); err != nil {
+			log.Println("Failed to notify user of contact change:", err)
+		}
+	}
+}
+
+func notifyContactRemoved(db *gorm.DB, redisStore *redis.Client, contact structs.Contact, userIds ...uuid.UUID) {
+	for _, userId := range userIds {
+		if err := notifyUser(db, redisStore, userId, "contact_removed", fiber.Map{"id": contact.ID}); err != nil {
+			log.Println("Failed to notify user of contact change:", err)
+		}
+	}
+}
+
+func ListContacts(c *fiber.Ctx, db *gorm.DB) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	query := visibleContacts(db, userId)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var contacts []structs.Contact
+	if err := query.Preload("Requester").Preload("Addressee").Order("created DESC").Find(&contacts).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	response := make([]structs.ContactResponse, len(contacts))
+	for i, contact := range contacts {
+		response[i] = contactResponse(contact, userId)
+	}
+	return c.JSON(response)
+}
+
+// InviteContact invites the user with the given email. Inviting someone who already invited
+// the caller accepts their invite instead.
+func InviteContact(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	body := new(structs.ContactInviteRequest)
+	if err := c.BodyParser(body); err != nil || strings.TrimSpace(body.Email) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email is required",
+		})
+	}
+
+	var invitee structs.User
+	if err := db.Where("LOWER(email) = LOWER(?)", strings.TrimSpace(body.Email)).First(&invitee).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No user with that email",
+		})
+	}
+	if invitee.ID == userId {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot add yourself as a contact",
+		})
+	}
+
+	var contact structs.Contact
+	err = db.Where("(requester_id = ? AND addressee_id = ?) OR (requester_id = ? AND addressee_id = ?)",
+		userId, invitee.ID, invitee.ID, userId).First(&contact).Error
+	eventType := "contact_invite"
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		contact = structs.Contact{RequesterId: userId, AddresseeId: invitee.ID, Status: ContactStatusPending}
+		err = db.Create(&contact).Error
+	case err != nil:
+	case contact.Status == ContactStatusBlocked:
+		// Don't tell the caller they've been blocked
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Cannot invite this user",
+		})
+	case contact.Status == ContactStatusAccepted:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Already a contact",
+		})
+	case contact.Status == ContactStatusPending && contact.RequesterId == userId:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Invite already sent",
+		})
+	case contact.Status == ContactStatusPending:
+		contact.Status = ContactStatusAccepted
+		eventType = "contact_accepted"
+		err = db.Model(&contact).Update("status", contact.Status).Error
+	default:
+		// Rejected invites can be sent again, by either side
+		contact.RequesterId, contact.AddresseeId, contact.Status = userId, invitee.ID, ContactStatusPending
+		err = db.Model(&contact).Select("requester_id", "addressee_id", "status").Updates(&contact).Error
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if err := db.Preload("Requester").Preload("Addressee").First(&contact, "id = ?", contact.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	notifyContactChange(db, redisStore, contact, eventType)
+	return c.Status(fiber.StatusCreated).JSON(contactResponse(contact, userId))
+}
+
+func AcceptContact(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	return answerContact(c, db, redisStore, ContactStatusAccepted)
+}
+
+func RejectContact(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	return answerContact(c, db, redisStore, ContactStatusRejected)
+}
+
+// answerContact settles a pending invite sent to the caller
+func answerContact(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client, status string) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var contact structs.Contact
+	err = db.Preload("Requester").Preload("Addressee").
+		Where("id = ? AND addressee_id = ? AND status = ?", c.Params("id"), userId, ContactStatusPending).
+		First(&contact).Error
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pending invite not found",
+		})
+	}
+
+	result := db.Model(&structs.Contact{}).
+		Where("id = ? AND status = ?", contact.ID, ContactStatusPending).
+		Update("status", status)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Invite has already been answered",
+		})
+	}
+	contact.Status = status
+
+	// The requester isn't told about rejections
+	if status == ContactStatusAccepted {
+		notifyContactChange(db, redisStore, contact, "contact_accepted")
+	}
+	return c.JSON(contactResponse(contact, userId))
+}
+
+// BlockContact blocks the other side of a contact or invite. They can't invite the caller
+// again or reach their devices until the caller deletes the block.
+func BlockContact(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var contact structs.Contact
+	err = visibleContacts(db, userId).Preload("Requester").Preload("Addressee").
+		Where("id = ?", c.Params("id")).First(&contact).Error
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Contact not found",
+		})
+	}
+
+	wasAccepted := contact.Status == ContactStatusAccepted
+	contact.Status, contact.BlockedBy = ContactStatusBlocked, &userId
+	if err := db.Model(&contact).Select("status", "blocked_by").Updates(&contact).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if wasAccepted {
+		// The other side only learns the contact is gone, not that they were blocked
+		notifyContactRemoved(db, redisStore, contact, contact.RequesterId, contact.AddresseeId)
+		// Both firewalls still admit the other user until their certs are renewed
+		for _, id := range []uuid.UUID{contact.RequesterId, contact.AddresseeId} {
+			if err := RequestCertRenewal(c.Context(), db, redisStore, id); err != nil {
+				log.Println("Failed to request cert renewal:", err)
+			}
+		}
+	}
+	return c.JSON(contactResponse(contact, userId))
+}
+
+// DeleteContact removes a contact, withdraws or dismisses an invite, or lifts the caller's block
+func DeleteContact(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var contact structs.Contact
+	err = visibleContacts(db, userId).Preload("Requester").Preload("Addressee").
+		Where("id = ?", c.Params("id")).First(&contact).Error
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Contact not found",
+		})
+	}
+
+	if err := db.Delete(&structs.Contact{}, "id = ?", contact.ID).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if contact.Status == ContactStatusAccepted {
+		notifyContactRemoved(db, redisStore, contact, contact.RequesterId, contact.AddresseeId)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ContactDevices lists the approved devices of an accepted contact, as much as the caller needs
+// to send to them
+func ContactDevices(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var contact structs.Contact
+	err = db.Where("id = ? AND status = ? AND (requester_id = ? OR addressee_id = ?)",
+		c.Params("id"), ContactStatusAccepted, userId, userId).First(&contact).Error
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Contact not found",
+		})
+	}
+
+	var devices []*structs.Device
+	err = db.Where("user_id = ? AND status = ?", otherParty(contact, userId), DeviceStatusApproved).
+		Order("machine_name ASC").Find(&devices).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if err := FillPresence(c.Context(), redisStore, devices); err != nil {
+		log.Println("Failed to read presence:", err)
+	}
+
+	return c.JSON(sharedDevices(devices))
+}
@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"testing"
+	structs "zeroshare-backend/structs"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPeerView tests that devices shown to other users keep their mesh address but not their hardware ID or owner
+func TestPeerView(t *testing.T) {
+	device := structs.Device{
+		ID:          uuid.New(),
+		MachineName: "laptop",
+		Platform:    "linux",
+		DeviceId:    "hardware-id",
+		IpAddress:   "10.0.0.5",
+		UserId:      uuid.New(),
+		User:        structs.User{Email: "owner@example.com"},
+	}
+
+	view := PeerView(device)
+	assert.Equal(t, device.ID, view.ID)
+	assert.Equal(t, device.IpAddress, view.IpAddress, "contacts reach the device over the mesh")
+	assert.Empty(t, view.DeviceId)
+	assert.Empty(t, view.User.Email)
+}
+
+// TestOtherParty tests that either side of a contact finds the other user
+func TestOtherParty(t *testing.T) {
+	requester, addressee := uuid.New(), uuid.New()
+	contact := structs.Contact{RequesterId: requester, AddresseeId: addressee}
+
+	assert.Equal(t, addressee, otherParty(contact, requester))
+	assert.Equal(t, requester, otherParty(contact, addressee))
+}
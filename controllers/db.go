@@ -41,6 +41,18 @@ func InitDatabase() *gorm.DB {
 	// AutoMigrate the User schema
 	db.AutoMigrate(&structs.User{})
 	db.AutoMigrate(&structs.Device{})
+	db.AutoMigrate(&structs.IpAllocation{}, &structs.IpReservation{})
+	db.AutoMigrate(&structs.HostCertificate{}, &structs.CertRevocation{}, &structs.CertificateAuthority{})
+	db.AutoMigrate(&structs.GroupAssignment{}, &structs.FirewallRule{})
+	db.AutoMigrate(&structs.Contact{}, &structs.Organization{}, &structs.OrganizationMember{})
+	db.AutoMigrate(&structs.Session{}, &structs.RefreshToken{}, &structs.SigningKey{})
+	db.AutoMigrate(&structs.Identity{})
+
+	// Users from before identities signed in with Google only
+	db.Exec("UPDATE users SET google_id = NULL WHERE google_id = ''")
+	db.Exec(`INSERT INTO identities (user_id, provider, subject, email, created, last_used)
+		SELECT id, 'google', google_id, email, EXTRACT(EPOCH FROM NOW())::bigint, 0 FROM users WHERE google_id IS NOT NULL
+		ON CONFLICT DO NOTHING`)
 
 	return db
 }
@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultDevicePageSize = 50
+	maxDevicePageSize     = 200
+)
+
+// Columns the device list can be sorted by
+var deviceSortColumns = map[string]string{
+	"machine_name": "machine_name",
+	"platform":     "platform",
+	"status":       "status",
+	"created":      "created",
+	"updated":      "updated",
+}
+
+// deviceOrder turns a sort param like "-updated" into an ORDER BY clause, a leading - sorts descending
+func deviceOrder(sort string) (string, error) {
+	if sort == "" {
+		return "created ASC, id ASC", nil
+	}
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction = "DESC"
+		sort = sort[1:]
+	}
+	column, ok := deviceSortColumns[sort]
+	if !ok {
+		return "", fmt.Errorf("can't sort devices by %q", sort)
+	}
+	// id keeps the order stable between pages when values tie
+	return fmt.Sprintf("%s %s, id ASC", column, direction), nil
+}
+
+func pageParams(c *fiber.Ctx) (int, int, error) {
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultDevicePageSize)))
+	if err != nil || limit < 1 || limit > maxDevicePageSize {
+		return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxDevicePageSize)
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("offset must not be negative")
+	}
+	return limit, offset, nil
+}
+
+// ListDevices pages through the caller's devices. Filters are platform, status and q, which matches
+// part of the machine name, and the total before paging is sent in X-Total-Count.
+func ListDevices(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, _ := GetFromToken(c, "ID")
+	return listDevices(c, redisStore, db.Model(&structs.Device{}).Where("user_id = ?", userId))
+}
+
+// listDevices pages through the devices query selects, see ListDevices for the parameters
+func listDevices(c *fiber.Ctx, redisStore *redis.Client, query *gorm.DB) error {
+	limit, offset, err := pageParams(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	order, err := deviceOrder(c.Query("sort"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if platform := c.Query("platform"); platform != "" {
+		query = query.Where("platform = ?", platform)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if search := c.Query("q"); search != "" {
+		query = query.Where("machine_name ILIKE ?", "%"+escapeLike(search)+"%")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	devices := []*structs.Device{}
+	if err := query.Order(order).Limit(limit).Offset(offset).Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if err := FillPresence(c.Context(), redisStore, devices); err != nil {
+		log.Println("Failed to load device presence:", err)
+	}
+
+	c.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	return c.JSON(devices)
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+func GetDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, _ := GetFromToken(c, "ID")
+	var device structs.Device
+	if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+	if err := FillPresence(c.Context(), redisStore, []*structs.Device{&device}); err != nil {
+		log.Println("Failed to load device presence:", err)
+	}
+	return c.JSON(device)
+}
+
+// UpdateDevice renames a device or updates its platform, other fields are managed by the backend
+func UpdateDevice(c *fiber.Ctx, db *gorm.DB) error {
+	body := new(structs.UpdateDeviceRequest)
+	if err := c.BodyParser(body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	updates := map[string]interface{}{}
+	if body.MachineName != nil {
+		if strings.TrimSpace(*body.MachineName) == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "machine_name must not be empty",
+			})
+		}
+		updates["machine_name"] = strings.TrimSpace(*body.MachineName)
+	}
+	if body.Platform != nil {
+		if strings.TrimSpace(*body.Platform) == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "platform must not be empty",
+			})
+		}
+		updates["platform"] = strings.TrimSpace(*body.Platform)
+	}
+	if len(updates) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Nothing to update",
+		})
+	}
+
+	userId, _ := GetFromToken(c, "ID")
+	var device structs.Device
+	if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+	if err := db.Model(&device).Updates(updates).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(device)
+}
+
+// DeleteDevice removes a device for good. Its certs are revoked first so the device is cut off
+// from the mesh straight away, then its overlay IP goes back to the pool.
+func DeleteDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, _ := GetFromToken(c, "ID")
+	var device structs.Device
+	if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+	return deleteDevice(c, db, redisStore, device)
+}
+
+// deleteDevice revokes the device's certs, frees its IP and removes it
+func deleteDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client, device structs.Device) error {
+	if _, err := RevokeDeviceCertificates(db, redisStore, device.ID, "device deleted"); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke certificates",
+		})
+	}
+	if err := ReleaseIP(db, device.ID); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to release IP address",
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("device_id = ?", device.ID).Delete(&structs.GroupAssignment{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&device).Error
+	})
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,378 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"html"
+	"math/big"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// RFC 8628 device authorization grant, for clients without a browser
+const (
+	deviceCodeTTL = 15 * time.Minute
+	// Seconds clients wait between polls, slow_down adds 5
+	deviceCodePollInterval = 5
+	deviceCodeGrantType    = "urn:ietf:params:oauth:grant-type:device_code"
+	// No vowels so codes don't spell words, no lookalike letters
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+const (
+	deviceCodeApproved = "approved"
+	deviceCodeDenied   = "denied"
+)
+
+var (
+	ErrUnknownUserCode    = errors.New("unknown or expired user code")
+	ErrDeviceCodeAnswered = errors.New("device code has already been answered")
+)
+
+// The device code's state is a hash keyed by its hash, the user code points at it, and the
+// approval is a separate key so only the first answer counts
+func deviceCodeKey(deviceCodeHash string) string {
+	return "device-code:" + deviceCodeHash
+}
+
+func deviceCodeDecisionKey(deviceCodeHash string) string {
+	return "device-code-decision:" + deviceCodeHash
+}
+
+func userCodeKey(userCode string) string {
+	return "device-user-code:" + userCode
+}
+
+func activationStateKey(state string) string {
+	return "device-activation:" + state
+}
+
+// newUserCode returns a code like WDJB-MJHT that is easy to type on another device
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code[:userCodeLength/2]) + "-" + string(code[userCodeLength/2:]), nil
+}
+
+// normalizeUserCode accepts codes typed in lower case or without the dash
+func normalizeUserCode(userCode string) string {
+	var normalized strings.Builder
+	for _, r := range strings.ToUpper(userCode) {
+		if strings.ContainsRune(userCodeAlphabet, r) {
+			normalized.WriteRune(r)
+		}
+	}
+	code := normalized.String()
+	if len(code) != userCodeLength {
+		return ""
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// deviceTokenError answers a token request with one of the RFC 6749 or 8628 error codes
+func deviceTokenError(c *fiber.Ctx, code string, description string) error {
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// DeviceAuthorization hands a headless client a device code to poll with and a user code for the
+// user to approve on a device that is signed in
+func DeviceAuthorization(c *fiber.Ctx, redisStore *redis.Client) error {
+	deviceCode, err := newRefreshToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "server_error",
+		})
+	}
+	deviceCodeHash := hashRefreshToken(deviceCode)
+
+	ctx := c.Context()
+	var userCode string
+	// Retry on the unlikely collision with a pending user code
+	for attempt := 0; attempt < 5 && userCode == ""; attempt++ {
+		candidate, err := newUserCode()
+		if err != nil {
+			break
+		}
+		if ok, err := redisStore.SetNX(ctx, userCodeKey(candidate), deviceCodeHash, deviceCodeTTL).Result(); err == nil && ok {
+			userCode = candidate
+		}
+	}
+	if userCode == "" {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "server_error",
+		})
+	}
+
+	expiresAt := time.Now().Add(deviceCodeTTL)
+	key := deviceCodeKey(deviceCodeHash)
+	_, err = redisStore.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"user_code", userCode,
+			"client_id", c.FormValue("client_id"),
+			"user_agent", c.Get(fiber.HeaderUserAgent),
+			"ip_address", c.IP(),
+			"expires_at", expiresAt.Unix(),
+			"interval", deviceCodePollInterval,
+			"last_poll", 0,
+		)
+		pipe.ExpireAt(ctx, key, expiresAt)
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "server_error",
+		})
+	}
+
+	verificationUri := publicURL(c) + "/activate"
+	return c.JSON(structs.DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: verificationUri + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(deviceCodeTTL.Seconds()),
+		Interval:                deviceCodePollInterval,
+	})
+}
+
+// DeviceToken is polled by the headless client until the user has answered, then it issues the
+// same tokens as the other sign in methods
+func DeviceToken(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	if c.FormValue("grant_type") != deviceCodeGrantType {
+		return deviceTokenError(c, "unsupported_grant_type", "Only the device code grant is supported")
+	}
+	deviceCode := c.FormValue("device_code")
+	if deviceCode == "" {
+		return deviceTokenError(c, "invalid_request", "Missing device_code")
+	}
+
+	ctx := c.Context()
+	deviceCodeHash := hashRefreshToken(deviceCode)
+	key := deviceCodeKey(deviceCodeHash)
+	pending, err := redisStore.HGetAll(ctx, key).Result()
+	if err != nil || pending["user_code"] == "" {
+		return deviceTokenError(c, "expired_token", "The device code has expired, start over")
+	}
+
+	decision, err := redisStore.Get(ctx, deviceCodeDecisionKey(deviceCodeHash)).Result()
+	if errors.Is(err, redis.Nil) {
+		// Clients polling faster than the interval are told to back off
+		now := time.Now().Unix()
+		lastPoll, _ := strconv.ParseInt(pending["last_poll"], 10, 64)
+		interval, _ := strconv.ParseInt(pending["interval"], 10, 64)
+		redisStore.HSet(ctx, key, "last_poll", now)
+		if now-lastPoll < interval {
+			redisStore.HIncrBy(ctx, key, "interval", 5)
+			return deviceTokenError(c, "slow_down", "Polling too often")
+		}
+		return deviceTokenError(c, "authorization_pending", "Waiting for the user to approve")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "server_error",
+		})
+	}
+
+	// Answered either way, the device code can't be used again
+	deleted, err := redisStore.Del(ctx, key, userCodeKey(pending["user_code"])).Result()
+	if err != nil || deleted == 0 {
+		return deviceTokenError(c, "expired_token", "The device code has expired, start over")
+	}
+	if decision == deviceCodeDenied {
+		return deviceTokenError(c, "access_denied", "The user denied the request")
+	}
+
+	var user structs.User
+	if err := db.Where("id = ?", strings.TrimPrefix(decision, deviceCodeApproved+":")).First(&user).Error; err != nil {
+		return deviceTokenError(c, "access_denied", "The approving user no longer exists")
+	}
+	tokenResponse, err := startSession(c, db, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "server_error",
+		})
+	}
+	return c.JSON(tokenResponse)
+}
+
+// lookupUserCode returns the hash of the device code a user code belongs to
+func lookupUserCode(c *fiber.Ctx, redisStore *redis.Client, userCode string) (string, error) {
+	userCode = normalizeUserCode(userCode)
+	if userCode == "" {
+		return "", ErrUnknownUserCode
+	}
+	deviceCodeHash, err := redisStore.Get(c.Context(), userCodeKey(userCode)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrUnknownUserCode
+	}
+	return deviceCodeHash, err
+}
+
+// answerDeviceCode records the user's decision, only the first answer counts
+func answerDeviceCode(c *fiber.Ctx, redisStore *redis.Client, userCode string, decision string) error {
+	deviceCodeHash, err := lookupUserCode(c, redisStore, userCode)
+	if err != nil {
+		return err
+	}
+	ttl, err := redisStore.TTL(c.Context(), deviceCodeKey(deviceCodeHash)).Result()
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return ErrUnknownUserCode
+	}
+	answered, err := redisStore.SetNX(c.Context(), deviceCodeDecisionKey(deviceCodeHash), decision, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !answered {
+		return ErrDeviceCodeAnswered
+	}
+	return nil
+}
+
+func deviceCodeError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrUnknownUserCode):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown or expired code",
+		})
+	case errors.Is(err, ErrDeviceCodeAnswered):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Code has already been answered",
+		})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to answer code",
+		})
+	}
+}
+
+// GetDeviceCode shows a signed in user which client is asking to sign in with a user code
+func GetDeviceCode(c *fiber.Ctx, redisStore *redis.Client) error {
+	deviceCodeHash, err := lookupUserCode(c, redisStore, c.Params("userCode"))
+	if err != nil {
+		return deviceCodeError(c, err)
+	}
+	pending, err := redisStore.HGetAll(c.Context(), deviceCodeKey(deviceCodeHash)).Result()
+	if err != nil || pending["user_code"] == "" {
+		return deviceCodeError(c, ErrUnknownUserCode)
+	}
+	expiresAt, _ := strconv.ParseInt(pending["expires_at"], 10, 64)
+	return c.JSON(structs.DeviceCodeInfo{
+		UserCode:  pending["user_code"],
+		ClientId:  pending["client_id"],
+		UserAgent: pending["user_agent"],
+		IpAddress: pending["ip_address"],
+		ExpiresAt: expiresAt,
+	})
+}
+
+// ApproveDeviceCode signs the client waiting on the user code in as the caller
+func ApproveDeviceCode(c *fiber.Ctx, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in token",
+		})
+	}
+	body := new(structs.UserCodeRequest)
+	c.BodyParser(body)
+	if err := answerDeviceCode(c, redisStore, body.UserCode, deviceCodeApproved+":"+userId.String()); err != nil {
+		return deviceCodeError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func DenyDeviceCode(c *fiber.Ctx, redisStore *redis.Client) error {
+	body := new(structs.UserCodeRequest)
+	c.BodyParser(body)
+	if err := answerDeviceCode(c, redisStore, body.UserCode, deviceCodeDenied); err != nil {
+		return deviceCodeError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ActivatePage is the verification URI. The user enters the code and signs in with a provider,
+// which approves it.
+func ActivatePage(c *fiber.Ctx) error {
+	names := make([]string, 0, len(identityProviders))
+	for name := range identityProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buttons strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&buttons, `<button type="submit" formaction="/activate/%s">Continue with %s</button>`,
+			url.PathEscape(name), html.EscapeString(name))
+	}
+
+	c.Type("html")
+	return c.SendString(fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Sign in a device to ZeroShare</title></head>
+<body><form method="get"><p>Enter the code shown on your device</p><input name="user_code" value="%s" autocomplete="off" required>%s</form></body></html>`,
+		html.EscapeString(c.Query("user_code")), buttons.String()))
+}
+
+// ActivateWithProvider sends the browser to sign in, the callback approves the code as the user
+// who signed in
+func ActivateWithProvider(c *fiber.Ctx, redisStore *redis.Client) error {
+	provider, ok := identityProviders[c.Params("provider")]
+	if !ok {
+		return unknownIdentityProvider(c)
+	}
+	userCode := normalizeUserCode(c.Query("user_code"))
+	if _, err := lookupUserCode(c, redisStore, userCode); err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("This code is unknown or has expired, check the code on your device")
+	}
+
+	state, err := newRefreshToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to start sign in")
+	}
+	if err := redisStore.Set(c.Context(), activationStateKey(state), userCode, deviceCodeTTL).Err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to start sign in")
+	}
+	return c.Redirect(provider.AuthCodeURL(state))
+}
+
+// completeActivation approves a user code for whoever signed in at the provider
+func completeActivation(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client, providerName string, profile structs.ProviderProfile, userCode string) error {
+	user, err := resolveIdentity(db, providerName, profile)
+	if err != nil {
+		status, message := identityError(err)
+		return c.Status(status).SendString(message)
+	}
+	if user.Suspended {
+		return c.Status(fiber.StatusForbidden).SendString("Account suspended")
+	}
+	err = answerDeviceCode(c, redisStore, userCode, deviceCodeApproved+":"+user.ID.String())
+	switch {
+	case errors.Is(err, ErrUnknownUserCode):
+		return c.Status(fiber.StatusNotFound).SendString("This code has expired, start over on your device")
+	case errors.Is(err, ErrDeviceCodeAnswered):
+		return c.Status(fiber.StatusConflict).SendString("This code has already been used")
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to approve device")
+	}
+	return c.SendString("Device signed in, you may close this window")
+}
@@ -0,0 +1,23 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUserCode tests that user codes are generated in the format they are normalized to
+func TestUserCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := newUserCode()
+		assert.NoError(t, err)
+		assert.Regexp(t, `^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`, code)
+		assert.Equal(t, code, normalizeUserCode(code))
+	}
+
+	assert.Equal(t, "WDJB-MJHT", normalizeUserCode("wdjbmjht"))
+	assert.Equal(t, "WDJB-MJHT", normalizeUserCode(" wdjb - mjht "))
+	assert.Equal(t, "", normalizeUserCode("WDJB-MJH"))
+	assert.Equal(t, "", normalizeUserCode("WDJB-MJHTX"))
+	assert.Equal(t, "", normalizeUserCode(""))
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDeviceOrder tests that only whitelisted sort fields reach the ORDER BY clause
+func TestDeviceOrder(t *testing.T) {
+	tests := []struct {
+		sort    string
+		want    string
+		wantErr bool
+	}{
+		{sort: "", want: "created ASC, id ASC"},
+		{sort: "machine_name", want: "machine_name ASC, id ASC"},
+		{sort: "-updated", want: "updated DESC, id ASC"},
+		{sort: "user_id", wantErr: true},
+		{sort: "created; DROP TABLE devices", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			order, err := deviceOrder(tt.sort)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, order)
+		})
+	}
+}
+
+// TestEscapeLike tests that search terms match LIKE wildcards literally
+func TestEscapeLike(t *testing.T) {
+	assert.Equal(t, `50\% off\_laptop\\`, escapeLike(`50% off_laptop\`))
+}
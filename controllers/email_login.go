@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"log"
+	"math/big"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	emailLoginTTL = 15 * time.Minute
+	// Wrong codes allowed before the challenge is thrown away
+	emailLoginAttempts = 5
+	// How often the same address can be sent a new code
+	emailLoginResendInterval = time.Minute
+)
+
+// Email sign ins are stored as identities of this provider, with the lower cased address as subject
+const emailProvider = "email"
+
+// The challenge for a session token is a hash holding the email and the hashes of its code and link
+func emailChallengeKey(sessionToken string) string {
+	return "email-login:" + sessionToken
+}
+
+func emailLinkKey(linkToken string) string {
+	return "email-link:" + hashEmailSecret(linkToken)
+}
+
+func emailThrottleKey(email string) string {
+	return "email-login-throttle:" + strings.ToLower(email)
+}
+
+func hashEmailSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newEmailCode returns a random 6 digit code
+func newEmailCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// publicURL is where browsers reach this backend, PUBLIC_URL or else the host of REDIRECT_URL
+func publicURL(c *fiber.Ctx) string {
+	if public := os.Getenv("PUBLIC_URL"); public != "" {
+		return strings.TrimSuffix(public, "/")
+	}
+	if redirect, err := url.Parse(os.Getenv("REDIRECT_URL")); err == nil && redirect.Host != "" {
+		return redirect.Scheme + "://" + redirect.Host
+	}
+	return c.BaseURL()
+}
+
+// StartEmailLogin mails a code and a magic link that sign in the app waiting on the session token.
+// It answers the same whether or not the address has an account.
+func StartEmailLogin(c *fiber.Ctx, redisStore *redis.Client) error {
+	body := new(structs.EmailLoginRequest)
+	if err := c.BodyParser(body); err != nil || body.SessionToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email and session token are required",
+		})
+	}
+	address, err := mail.ParseAddress(body.Email)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid email address",
+		})
+	}
+	email := address.Address
+
+	ctx := c.Context()
+	if !loginSessionExists(ctx, redisStore, body.SessionToken) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown or expired login session",
+		})
+	}
+	first, err := redisStore.SetNX(ctx, emailThrottleKey(email), 1, emailLoginResendInterval).Result()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start sign in",
+		})
+	}
+	if !first {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "A code was sent recently, try again in a minute",
+		})
+	}
+
+	code, err := newEmailCode()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start sign in",
+		})
+	}
+	linkToken, err := newRefreshToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start sign in",
+		})
+	}
+
+	// A new request for the same session token replaces the old challenge
+	key := emailChallengeKey(body.SessionToken)
+	_, err = redisStore.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key,
+			"email", email,
+			"code", hashEmailSecret(body.SessionToken+":"+code),
+			"link", hashEmailSecret(linkToken),
+			"attempts", 0,
+		)
+		pipe.Expire(ctx, key, emailLoginTTL)
+		pipe.Set(ctx, emailLinkKey(linkToken), body.SessionToken, emailLoginTTL)
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start sign in",
+		})
+	}
+
+	link := publicURL(c) + "/login/email/link?token=" + url.QueryEscape(linkToken)
+	err = mailer.Send(ctx, MailMessage{
+		To:      email,
+		Subject: "Your ZeroShare sign in code: " + code,
+		Body: fmt.Sprintf("Enter this code in ZeroShare to sign in:\n\n%s\n\nOr open this link on the same computer:\n\n%s\n\nThe code expires in %d minutes. If you didn't try to sign in, you can ignore this email.\n",
+			code, link, int(emailLoginTTL.Minutes())),
+	})
+	if err != nil {
+		log.Println("Failed to send sign in email:", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to send email",
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"expires_in": int(emailLoginTTL.Seconds()),
+	})
+}
+
+// claimEmailChallenge deletes the challenge, only the caller that deleted it may sign in with it
+func claimEmailChallenge(c *fiber.Ctx, redisStore *redis.Client, sessionToken string) bool {
+	deleted, err := redisStore.Del(c.Context(), emailChallengeKey(sessionToken)).Result()
+	return err == nil && deleted > 0
+}
+
+// completeEmailLogin signs in the owner of email, creating the user on first sign in
+func completeEmailLogin(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client, sessionToken string, email string) error {
+	profile := structs.ProviderProfile{
+		Subject:       strings.ToLower(email),
+		Email:         email,
+		EmailVerified: true,
+		Name:          strings.SplitN(email, "@", 2)[0],
+	}
+	user, err := resolveIdentity(db, emailProvider, profile)
+	if err != nil {
+		return err
+	}
+	return publishSession(c, db, redisStore, sessionToken, user)
+}
+
+// VerifyEmailCode checks a code typed into the app. The tokens go to /sse/:sessionToken like the
+// other sign in methods.
+func VerifyEmailCode(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	body := new(structs.EmailCodeRequest)
+	if err := c.BodyParser(body); err != nil || body.SessionToken == "" || body.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Session token and code are required",
+		})
+	}
+
+	ctx := c.Context()
+	key := emailChallengeKey(body.SessionToken)
+	challenge, err := redisStore.HGetAll(ctx, key).Result()
+	if err != nil || challenge["code"] == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "No sign in is pending, request a new code",
+		})
+	}
+	attempts, err := redisStore.HIncrBy(ctx, key, "attempts", 1).Result()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify code",
+		})
+	}
+	if attempts > emailLoginAttempts {
+		redisStore.Del(ctx, key)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many attempts, request a new code",
+		})
+	}
+
+	hash := hashEmailSecret(body.SessionToken + ":" + strings.TrimSpace(body.Code))
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(challenge["code"])) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+	if !claimEmailChallenge(c, redisStore, body.SessionToken) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "No sign in is pending, request a new code",
+		})
+	}
+
+	if err := completeEmailLogin(c, db, redisStore, body.SessionToken, challenge["email"]); err != nil {
+		status, message := identityError(err)
+		return c.Status(status).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ConfirmEmailLink shows a button that submits the magic link. Mail scanners open links on their
+// own, so opening it doesn't sign in by itself.
+func ConfirmEmailLink(c *fiber.Ctx) error {
+	c.Type("html")
+	return c.SendString(fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Sign in to ZeroShare</title></head>
+<body><form method="post" action="/login/email/link"><input type="hidden" name="token" value="%s"><button type="submit">Sign in to ZeroShare</button></form></body></html>`,
+		html.EscapeString(c.Query("token"))))
+}
+
+// VerifyEmailLink signs in with the token from a magic link
+func VerifyEmailLink(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	linkToken := c.FormValue("token")
+	if linkToken == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Missing sign in link")
+	}
+
+	ctx := c.Context()
+	sessionToken, err := redisStore.GetDel(ctx, emailLinkKey(linkToken)).Result()
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString("This sign in link has expired or was already used")
+	}
+	challenge, err := redisStore.HGetAll(ctx, emailChallengeKey(sessionToken)).Result()
+	// The link of a replaced challenge no longer works
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashEmailSecret(linkToken)), []byte(challenge["link"])) != 1 {
+		return c.Status(fiber.StatusUnauthorized).SendString("This sign in link has expired or was already used")
+	}
+	if !claimEmailChallenge(c, redisStore, sessionToken) {
+		return c.Status(fiber.StatusUnauthorized).SendString("This sign in link has expired or was already used")
+	}
+
+	if err := completeEmailLogin(c, db, redisStore, sessionToken, challenge["email"]); err != nil {
+		status, message := identityError(err)
+		return c.Status(status).SendString(message)
+	}
+	return c.SendString("You may close this window")
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNewEmailCode tests that codes are always 6 digits
+func TestNewEmailCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := newEmailCode()
+		assert.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile(`^[0-9]{6}$`), code)
+	}
+}
+
+// TestFileMailer tests that the file mailer appends each email to its file
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.txt")
+	m := &fileMailer{path: path}
+
+	assert.NoError(t, m.Send(context.Background(), MailMessage{To: "a@example.com", Subject: "First", Body: "123456"}))
+	assert.NoError(t, m.Send(context.Background(), MailMessage{To: "b@example.com", Subject: "Second", Body: "line\nbreak"}))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "To: a@example.com\r\nSubject: First\r\n")
+	assert.Contains(t, string(content), "To: b@example.com\r\nSubject: Second\r\n")
+	assert.Contains(t, string(content), "line\r\nbreak")
+}
+
+// TestPublicURL tests that magic links fall back to the host of the OAuth redirect URL
+func TestPublicURL(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "")
+	t.Setenv("REDIRECT_URL", "https://api.example.com/auth/google/callback")
+	assert.Equal(t, "https://api.example.com", publicURL(nil))
+
+	t.Setenv("PUBLIC_URL", "https://zeroshare.example.com/")
+	assert.Equal(t, "https://zeroshare.example.com", publicURL(nil))
+}
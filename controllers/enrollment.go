@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusRejected = "rejected"
+)
+
+var (
+	ErrDeviceNotApproved     = errors.New("device has not been approved")
+	ErrPendingDeviceNotFound = errors.New("pending device not found")
+	ErrDeviceDecided         = errors.New("device has already been approved or rejected")
+)
+
+// Approval mode is opt in, without it every new device is approved straight away
+func approvalRequired() bool {
+	return os.Getenv("REQUIRE_DEVICE_APPROVAL") == "true"
+}
+
+// InitialDeviceStatus is the status a newly registered device of the user starts in. A user's
+// first device is approved since there is no trusted device yet to approve it.
+func InitialDeviceStatus(db *gorm.DB, userId uuid.UUID) (string, error) {
+	if !approvalRequired() {
+		return DeviceStatusApproved, nil
+	}
+
+	var approved int64
+	err := db.Model(&structs.Device{}).
+		Where("user_id = ? AND status = ?", userId, DeviceStatusApproved).
+		Count(&approved).Error
+	if err != nil {
+		return "", err
+	}
+	if approved == 0 {
+		return DeviceStatusApproved, nil
+	}
+	return DeviceStatusPending, nil
+}
+
+// RequestDeviceApproval asks the user's approved devices over /stream to approve a pending device.
+// They answer with a device_approve or device_reject message naming it as deviceId.
+func RequestDeviceApproval(db *gorm.DB, redisStore *redis.Client, device structs.Device) error {
+	var approvers []structs.Device
+	err := db.Where("user_id = ? AND status = ? AND id <> ?", device.UserId, DeviceStatusApproved, device.ID).
+		Find(&approvers).Error
+	if err != nil {
+		return err
+	}
+
+	for _, approver := range approvers {
+		if err := notifyDevice(redisStore, approver.ID, "device_approval_request", device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ApproveDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	return decideDevice(c, db, redisStore, DeviceStatusApproved)
+}
+
+func RejectDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	return decideDevice(c, db, redisStore, DeviceStatusRejected)
+}
+
+// decideDevice settles a pending device for an admin, or an organization admin for their members'
+// devices. A user's own devices answer approval requests over /stream instead, which proves the
+// answer comes from the approved device itself.
+func decideDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client, status string) error {
+	query := db.Where("id = ? AND status = ?", c.Params("id"), DeviceStatusPending)
+	if !IsAdmin(c) {
+		userId, _ := GetFromToken(c, "ID")
+		owners, err := managedUserIds(db, userId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if len(owners) == 0 {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Answer the approval request from one of your approved devices",
+			})
+		}
+		query = query.Where("user_id IN ?", owners)
+	}
+
+	device, err := settleDevice(db, redisStore, query, status)
+	switch {
+	case errors.Is(err, ErrPendingDeviceNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pending device not found",
+		})
+	case errors.Is(err, ErrDeviceDecided):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Device has already been approved or rejected",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(device)
+}
+
+// StreamDeviceDecision settles a pending device of the approver's user, for the device_approve and
+// device_reject messages an approved device sends over its own /stream connection
+func StreamDeviceDecision(db *gorm.DB, redisStore *redis.Client, approver structs.Device, deviceId string, status string) error {
+	// The stream's device may have been rejected or deleted since it connected
+	err := db.Where("id = ? AND status = ?", approver.ID, DeviceStatusApproved).First(&structs.Device{}).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrDeviceNotApproved
+	}
+	if err != nil {
+		return err
+	}
+	query := db.Where("id = ? AND user_id = ? AND status = ?", deviceId, approver.UserId, DeviceStatusPending)
+	_, err = settleDevice(db, redisStore, query, status)
+	return err
+}
+
+// settleDevice moves the pending device the query finds to status and tells the device
+func settleDevice(db *gorm.DB, redisStore *redis.Client, query *gorm.DB, status string) (structs.Device, error) {
+	var device structs.Device
+	err := query.First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return device, ErrPendingDeviceNotFound
+	}
+	if err != nil {
+		return device, err
+	}
+
+	// Only move devices that are still pending, in case two devices answer at once
+	result := db.Model(&structs.Device{}).
+		Where("id = ? AND status = ?", device.ID, DeviceStatusPending).
+		Update("status", status)
+	if result.Error != nil {
+		return device, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return device, ErrDeviceDecided
+	}
+	device.Status = status
+
+	if err := notifyDevice(redisStore, device.ID, "device_"+status, device); err != nil {
+		log.Println("Failed to notify device:", err)
+	}
+	return device, nil
+}
+
+// notifyDevice queues a backend event about device for the device with deviceId
+func notifyDevice(redisStore *redis.Client, deviceId uuid.UUID, eventType string, device structs.Device) error {
+	response, err := deviceEvent(eventType, device)
+	if err != nil {
+		return err
+	}
+	return DeliverToDevice(context.Background(), redisStore, deviceId.String(), &response)
+}
+
+func deviceEvent(eventType string, device structs.Device) (structs.SSEResponse, error) {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return structs.SSEResponse{}, err
+	}
+	return structs.SSEResponse{
+		Type:   eventType,
+		Data:   data,
+		Device: device,
+	}, nil
+}
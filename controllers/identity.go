@@ -0,0 +1,418 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// How long a link started with LinkIdentity waits for the provider's callback
+const identityLinkTTL = 10 * time.Minute
+
+// Set on the browser that starts a link, like login_state for sign ins
+const linkStateCookie = "link_state"
+
+var (
+	ErrNoProviderSubject = errors.New("identity provider returned no subject")
+	ErrNoProviderEmail   = errors.New("identity provider returned no email address")
+	// Users are only created for, and linked by, email addresses the provider has verified
+	ErrEmailUnverified = errors.New("email address is not verified by the identity provider")
+	// The email belongs to a user who never verified it, so a new sign in can't be trusted with it
+	ErrAccountUnverified = errors.New("email address belongs to an account that hasn't verified it, sign in the way you first did")
+	ErrIdentityInUse     = errors.New("identity is linked to another user")
+	ErrLastIdentity      = errors.New("cannot unlink the only identity")
+)
+
+var identityProviders = map[string]IdentityProvider{}
+
+// InitIdentityProviders registers the providers configured in the environment. Google uses
+// CLIENT_ID, CLIENT_SECRET and REDIRECT_URL, GitHub GITHUB_CLIENT_ID and GITHUB_CLIENT_SECRET,
+// Microsoft MICROSOFT_CLIENT_ID, MICROSOFT_CLIENT_SECRET and MICROSOFT_TENANT, and any other
+// OpenID Connect provider OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_NAME. Microsoft
+// apps need the xms_edov optional claim in their ID tokens, users whose email domain isn't
+// verified by their tenant can't sign in.
+func InitIdentityProviders(ctx context.Context) {
+	if os.Getenv("CLIENT_ID") != "" {
+		registerIdentityProvider(newGoogleProvider())
+	}
+	if os.Getenv("GITHUB_CLIENT_ID") != "" {
+		registerIdentityProvider(newGithubProvider())
+	}
+	if clientID := os.Getenv("MICROSOFT_CLIENT_ID"); clientID != "" {
+		tenant := os.Getenv("MICROSOFT_TENANT")
+		if tenant == "" {
+			tenant = "common"
+		}
+		// The common endpoint's discovery document has a {tenantid} placeholder in its issuer
+		issuer := "https://login.microsoftonline.com/" + tenant + "/v2.0"
+		provider, err := newOIDCProvider(ctx, "microsoft", issuer, clientID, os.Getenv("MICROSOFT_CLIENT_SECRET"), []string{"email", "profile"})
+		if err != nil {
+			log.Println("Failed to set up Microsoft sign in:", err)
+		} else {
+			registerIdentityProvider(provider)
+		}
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		name := strings.ToLower(os.Getenv("OIDC_NAME"))
+		if name == "" {
+			name = "oidc"
+		}
+		provider, err := newOIDCProvider(ctx, name, issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), []string{"email", "profile"})
+		if err != nil {
+			log.Printf("Failed to set up %s sign in: %v", name, err)
+		} else {
+			registerIdentityProvider(provider)
+		}
+	}
+}
+
+func registerIdentityProvider(provider IdentityProvider) {
+	identityProviders[provider.Name()] = provider
+	log.Printf("Sign in with %s enabled", provider.Name())
+}
+
+// ListIdentityProviders tells clients which providers they can offer
+func ListIdentityProviders(c *fiber.Ctx) error {
+	providers := []fiber.Map{}
+	for name, provider := range identityProviders {
+		_, idTokens := provider.(IDTokenVerifier)
+		providers = append(providers, fiber.Map{
+			"name":      name,
+			"id_tokens": idTokens,
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i]["name"].(string) < providers[j]["name"].(string)
+	})
+	return c.JSON(providers)
+}
+
+func unknownIdentityProvider(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "Unknown identity provider",
+	})
+}
+
+// resolveIdentity finds the user behind a provider profile. Unknown identities need an email the
+// provider verified, they are linked to the user with that email if the user verified it too,
+// otherwise they get a new user.
+func resolveIdentity(db *gorm.DB, providerName string, profile structs.ProviderProfile) (structs.User, error) {
+	if profile.Subject == "" {
+		return structs.User{}, ErrNoProviderSubject
+	}
+	now := time.Now().Unix()
+
+	var identity structs.Identity
+	err := db.Preload("User").Where("provider = ? AND subject = ?", providerName, profile.Subject).First(&identity).Error
+	if err == nil {
+		err = db.Model(&identity).Updates(map[string]interface{}{
+			"email":     profile.Email,
+			"last_used": now,
+		}).Error
+		return identity.User, err
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return structs.User{}, err
+	}
+	if profile.Email == "" {
+		return structs.User{}, ErrNoProviderEmail
+	}
+	if !profile.EmailVerified {
+		return structs.User{}, ErrEmailUnverified
+	}
+
+	var user structs.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("LOWER(email) = LOWER(?)", profile.Email).First(&user).Error
+		switch {
+		case err == nil && !user.VerifiedEmail:
+			return ErrAccountUnverified
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			user = structs.User{
+				Email:         profile.Email,
+				FamilyName:    profile.FamilyName,
+				GivenName:     profile.GivenName,
+				Locale:        profile.Locale,
+				Name:          profile.Name,
+				Picture:       profile.Picture,
+				VerifiedEmail: profile.EmailVerified,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+		return tx.Create(&structs.Identity{
+			UserId:   user.ID,
+			Provider: providerName,
+			Subject:  profile.Subject,
+			Email:    profile.Email,
+			LastUsed: now,
+		}).Error
+	})
+	return user, err
+}
+
+// linkIdentity adds a provider identity to an existing user
+func linkIdentity(db *gorm.DB, userId uuid.UUID, providerName string, profile structs.ProviderProfile) error {
+	if profile.Subject == "" {
+		return ErrNoProviderSubject
+	}
+	var identity structs.Identity
+	err := db.Where("provider = ? AND subject = ?", providerName, profile.Subject).First(&identity).Error
+	if err == nil {
+		if identity.UserId != userId {
+			return ErrIdentityInUse
+		}
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	return db.Create(&structs.Identity{
+		UserId:   userId,
+		Provider: providerName,
+		Subject:  profile.Subject,
+		Email:    profile.Email,
+	}).Error
+}
+
+// identityError maps errors from resolving or linking identities and completing login sessions to
+// a status and message
+func identityError(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrEmailUnverified), errors.Is(err, ErrAccountUnverified), errors.Is(err, ErrIdentityInUse):
+		return fiber.StatusConflict, err.Error()
+	case errors.Is(err, ErrNoProviderSubject), errors.Is(err, ErrNoProviderEmail):
+		return fiber.StatusBadGateway, err.Error()
+	case errors.Is(err, ErrUnknownLoginSession):
+		return fiber.StatusNotFound, "This sign in has expired, start over in the app"
+	case errors.Is(err, ErrLoginSessionClaimed):
+		return fiber.StatusConflict, "This sign in has already been completed"
+	default:
+		return fiber.StatusInternalServerError, "Database error"
+	}
+}
+
+func linkStateKey(state string) string {
+	return "identity-link:" + state
+}
+
+// LoginRedirect sends the browser to the provider to sign in the login session the app is
+// waiting on at /sse/:sessionToken
+func LoginRedirect(c *fiber.Ctx, redisStore *redis.Client, providerName string, sessionToken string) error {
+	provider, ok := identityProviders[providerName]
+	if !ok {
+		return unknownIdentityProvider(c)
+	}
+	state, err := startOAuthLogin(c, redisStore, sessionToken)
+	if errors.Is(err, ErrUnknownLoginSession) {
+		return c.Status(fiber.StatusNotFound).SendString("This sign in has expired, start over in the app")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to start sign in")
+	}
+	return c.Redirect(provider.AuthCodeURL(state))
+}
+
+// ProviderCallback finishes a browser sign in, link or device activation. Sign ins publish their
+// tokens to the login session the state was issued for.
+func ProviderCallback(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	provider, ok := identityProviders[c.Params("provider")]
+	if !ok {
+		return unknownIdentityProvider(c)
+	}
+	code := c.Query("code")
+	if code == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Missing authorization code")
+	}
+	profile, err := provider.Exchange(c.Context(), code)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to exchange token: " + err.Error())
+	}
+
+	state := c.Query("state")
+	if userId, err := redisStore.GetDel(c.Context(), linkStateKey(state)).Result(); err == nil {
+		if !checkStateCookie(c, linkStateCookie, state) {
+			return c.Status(fiber.StatusForbidden).SendString("Finish linking in the browser you started in")
+		}
+		uid, err := uuid.Parse(userId)
+		if err == nil {
+			err = linkIdentity(db, uid, provider.Name(), profile)
+		}
+		if err != nil {
+			status, message := identityError(err)
+			return c.Status(status).SendString(message)
+		}
+		return c.SendString("Account linked, you may close this window")
+	}
+
+	if userCode, err := redisStore.GetDel(c.Context(), activationStateKey(state)).Result(); err == nil {
+		return completeActivation(c, db, redisStore, provider.Name(), profile, userCode)
+	}
+
+	sessionToken, err := finishOAuthLogin(c, redisStore, state)
+	if errors.Is(err, ErrLoginStateMismatch) {
+		return c.Status(fiber.StatusForbidden).SendString("Finish signing in in the browser you started in")
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("This sign in has expired, start over in the app")
+	}
+
+	user, err := resolveIdentity(db, provider.Name(), profile)
+	if err != nil {
+		status, message := identityError(err)
+		return c.Status(status).SendString(message)
+	}
+
+	if err := publishSession(c, db, redisStore, sessionToken, user); err != nil {
+		status, message := identityError(err)
+		return c.Status(status).SendString(message)
+	}
+	return c.Status(200).SendString("You may close this window")
+}
+
+// publishSession starts a session for user and hands its tokens to the app waiting on
+// /sse/:sessionToken
+func publishSession(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client, sessionToken string, user structs.User) error {
+	if err := completeLoginSession(c.Context(), redisStore, sessionToken); err != nil {
+		return err
+	}
+	log.Printf("Sending publish message to %s -> %s", sessionToken, user.ID)
+	tokenResponse, err := startSession(c, db, user)
+	if err != nil {
+		return err
+	}
+	return publishTokens(redisStore, sessionToken, tokenResponse)
+}
+
+// VerifyProviderToken signs in native clients with an ID token they got from the provider's SDK
+func VerifyProviderToken(c *fiber.Ctx, db *gorm.DB, providerName string, token string) error {
+	provider, ok := identityProviders[providerName]
+	if !ok {
+		return unknownIdentityProvider(c)
+	}
+	verifier, ok := provider.(IDTokenVerifier)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Provider does not support ID token sign in",
+		})
+	}
+	profile, err := verifier.VerifyIDToken(c.Context(), token)
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid ID token",
+		})
+	}
+
+	user, err := resolveIdentity(db, provider.Name(), profile)
+	if err != nil {
+		status, message := identityError(err)
+		return c.Status(status).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+	tokenResponse, err := startSession(c, db, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start session",
+		})
+	}
+	return c.JSON(tokenResponse)
+}
+
+// LinkIdentity starts linking another provider to the caller. The client opens the returned URL
+// in the browser that made this request, the callback then adds the identity instead of signing
+// in. The state cookie keeps anyone else's browser from finishing the link with their identity.
+func LinkIdentity(c *fiber.Ctx, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in token",
+		})
+	}
+	provider, ok := identityProviders[c.Params("provider")]
+	if !ok {
+		return unknownIdentityProvider(c)
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start link",
+		})
+	}
+	state := base64.RawURLEncoding.EncodeToString(nonce)
+	if err := redisStore.Set(c.Context(), linkStateKey(state), userId.String(), identityLinkTTL).Err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start link",
+		})
+	}
+	setStateCookie(c, linkStateCookie, state, identityLinkTTL)
+	return c.JSON(fiber.Map{
+		"url": provider.AuthCodeURL(state),
+	})
+}
+
+func ListIdentities(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	var identities []structs.Identity
+	if err := db.Where("user_id = ?", userId).Order("created ASC").Find(&identities).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(identities)
+}
+
+// UnlinkIdentity removes one of the caller's identities, as long as another one is left to sign in with
+func UnlinkIdentity(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var identities []structs.Identity
+		// Locked so two concurrent unlinks can't remove the last two identities
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userId).Find(&identities).Error; err != nil {
+			return err
+		}
+		for _, identity := range identities {
+			if identity.ID.String() != c.Params("id") {
+				continue
+			}
+			if len(identities) == 1 {
+				return ErrLastIdentity
+			}
+			return tx.Delete(&identity).Error
+		}
+		return gorm.ErrRecordNotFound
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Identity not found",
+		})
+	case errors.Is(err, ErrLastIdentity):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Cannot unlink the only identity",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
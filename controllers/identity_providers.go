@@ -0,0 +1,359 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/MicahParks/keyfunc/v2"
+	jtoken "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+	idToken "google.golang.org/api/idtoken"
+)
+
+// IdentityProvider signs users in through an OAuth authorization code flow
+type IdentityProvider interface {
+	Name() string
+	AuthCodeURL(state string) string
+	// Exchange turns the code the provider redirected back with into the user's profile
+	Exchange(ctx context.Context, code string) (structs.ProviderProfile, error)
+}
+
+// IDTokenVerifier is implemented by providers whose ID tokens native clients can sign in with
+type IDTokenVerifier interface {
+	VerifyIDToken(ctx context.Context, token string) (structs.ProviderProfile, error)
+}
+
+// callbackURL is where the provider redirects back to. <NAME>_REDIRECT_URL overrides the default,
+// which is REDIRECT_URL with google swapped for the provider's name.
+func callbackURL(name string) string {
+	if url := os.Getenv(strings.ToUpper(name) + "_REDIRECT_URL"); url != "" {
+		return url
+	}
+	return strings.Replace(os.Getenv("REDIRECT_URL"), "/google/", "/"+name+"/", 1)
+}
+
+// getJSON fetches url with client and decodes the response into v
+func getJSON(client *http.Client, url string, v interface{}) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+type googleProvider struct {
+	conf *oauth2.Config
+}
+
+func newGoogleProvider() *googleProvider {
+	return &googleProvider{conf: &oauth2.Config{
+		ClientID:     os.Getenv("CLIENT_ID"),
+		ClientSecret: os.Getenv("CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("REDIRECT_URL"),
+		Scopes: []string{
+			"https://www.googleapis.com/auth/userinfo.email",
+			"https://www.googleapis.com/auth/userinfo.profile",
+		},
+		Endpoint: google.Endpoint,
+	}}
+}
+
+func (p *googleProvider) Name() string {
+	return "google"
+}
+
+func (p *googleProvider) AuthCodeURL(state string) string {
+	return p.conf.AuthCodeURL(state)
+}
+
+func (p *googleProvider) Exchange(ctx context.Context, code string) (structs.ProviderProfile, error) {
+	token, err := p.conf.Exchange(ctx, code)
+	if err != nil {
+		return structs.ProviderProfile{}, err
+	}
+	var info struct {
+		ID            string `json:"id"`
+		Email         string `json:"email"`
+		VerifiedEmail bool   `json:"verified_email"`
+		Name          string `json:"name"`
+		GivenName     string `json:"given_name"`
+		FamilyName    string `json:"family_name"`
+		Picture       string `json:"picture"`
+		Locale        string `json:"locale"`
+	}
+	if err := getJSON(p.conf.Client(ctx, token), "https://www.googleapis.com/oauth2/v2/userinfo", &info); err != nil {
+		return structs.ProviderProfile{}, err
+	}
+	return structs.ProviderProfile{
+		Subject:       info.ID,
+		Email:         info.Email,
+		EmailVerified: info.VerifiedEmail,
+		Name:          info.Name,
+		GivenName:     info.GivenName,
+		FamilyName:    info.FamilyName,
+		Picture:       info.Picture,
+		Locale:        info.Locale,
+	}, nil
+}
+
+func (p *googleProvider) VerifyIDToken(ctx context.Context, token string) (structs.ProviderProfile, error) {
+	payload, err := idToken.Validate(ctx, token, p.conf.ClientID)
+	if err != nil {
+		return structs.ProviderProfile{}, err
+	}
+	claim := func(key string) string {
+		value, _ := payload.Claims[key].(string)
+		return value
+	}
+	verified, _ := payload.Claims["email_verified"].(bool)
+	return structs.ProviderProfile{
+		Subject:       payload.Subject,
+		Email:         claim("email"),
+		EmailVerified: verified,
+		Name:          claim("name"),
+		GivenName:     claim("given_name"),
+		FamilyName:    claim("family_name"),
+		Picture:       claim("picture"),
+		Locale:        claim("locale"),
+	}, nil
+}
+
+type githubProvider struct {
+	conf *oauth2.Config
+}
+
+func newGithubProvider() *githubProvider {
+	return &githubProvider{conf: &oauth2.Config{
+		ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
+		ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+		RedirectURL:  callbackURL("github"),
+		Scopes:       []string{"read:user", "user:email"},
+		Endpoint:     github.Endpoint,
+	}}
+}
+
+func (p *githubProvider) Name() string {
+	return "github"
+}
+
+func (p *githubProvider) AuthCodeURL(state string) string {
+	return p.conf.AuthCodeURL(state)
+}
+
+func (p *githubProvider) Exchange(ctx context.Context, code string) (structs.ProviderProfile, error) {
+	token, err := p.conf.Exchange(ctx, code)
+	if err != nil {
+		return structs.ProviderProfile{}, err
+	}
+	client := p.conf.Client(ctx, token)
+
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := getJSON(client, "https://api.github.com/user", &user); err != nil {
+		return structs.ProviderProfile{}, err
+	}
+	// The profile email is optional and unverified, the primary one from /user/emails is neither
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(client, "https://api.github.com/user/emails", &emails); err != nil {
+		return structs.ProviderProfile{}, err
+	}
+
+	profile := structs.ProviderProfile{
+		Subject: strconv.FormatInt(user.ID, 10),
+		Name:    user.Name,
+		Picture: user.AvatarURL,
+	}
+	if profile.Name == "" {
+		profile.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email, profile.EmailVerified = email.Email, email.Verified
+		}
+	}
+	return profile, nil
+}
+
+// oidcProvider works with any OpenID Connect provider that supports discovery, e.g. Okta or
+// Microsoft Entra ID
+type oidcProvider struct {
+	name        string
+	conf        *oauth2.Config
+	issuer      string
+	userinfoURL string
+	jwks        *keyfunc.JWKS
+}
+
+func newOIDCProvider(ctx context.Context, name string, issuer string, clientID string, clientSecret string, scopes []string) (*oidcProvider, error) {
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(http.DefaultClient, discoveryURL, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("%s has no userinfo endpoint", issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("%s has no jwks_uri", issuer)
+	}
+	jwks, err := keyfunc.Get(discovery.JWKSURI, keyfunc.Options{
+		Ctx:               ctx,
+		RefreshInterval:   time.Hour,
+		RefreshRateLimit:  5 * time.Minute,
+		RefreshUnknownKID: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &oidcProvider{
+		name: name,
+		conf: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  callbackURL(name),
+			Scopes:       append([]string{"openid"}, scopes...),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  discovery.AuthorizationEndpoint,
+				TokenURL: discovery.TokenEndpoint,
+			},
+		},
+		issuer:      discovery.Issuer,
+		userinfoURL: discovery.UserinfoEndpoint,
+		jwks:        jwks,
+	}, nil
+}
+
+func (p *oidcProvider) Name() string {
+	return p.name
+}
+
+func (p *oidcProvider) AuthCodeURL(state string) string {
+	return p.conf.AuthCodeURL(state)
+}
+
+// oidcClaims are the profile claims of both ID tokens and userinfo responses
+type oidcClaims struct {
+	Subject    string `json:"sub"`
+	Email      string `json:"email"`
+	Name       string `json:"name"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+	Picture    string `json:"picture"`
+	Locale     string `json:"locale"`
+	// Some providers send "true" as a string
+	EmailVerified interface{} `json:"email_verified"`
+	// Entra ID never sends email_verified, the optional xms_edov claim says the email's domain
+	// is verified by the user's tenant
+	DomainVerified interface{} `json:"xms_edov"`
+}
+
+func claimTrue(value interface{}) bool {
+	return value == true || value == "true" || value == "1"
+}
+
+// verifyIDToken checks the ID token's signature against the provider's keys, its audience and
+// its issuer. Entra ID's multi-tenant issuer has a {tenantid} placeholder filled from the tid claim.
+func (p *oidcProvider) verifyIDToken(raw string) (oidcClaims, error) {
+	claims := jtoken.MapClaims{}
+	_, err := jtoken.ParseWithClaims(raw, claims, p.jwks.Keyfunc,
+		jtoken.WithAudience(p.conf.ClientID),
+		jtoken.WithExpirationRequired(),
+		jtoken.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256"}),
+	)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	issuer, _ := claims["iss"].(string)
+	tenant, _ := claims["tid"].(string)
+	if issuer != strings.Replace(p.issuer, "{tenantid}", tenant, 1) {
+		return oidcClaims{}, fmt.Errorf("ID token issued by %q, not %q", issuer, p.issuer)
+	}
+
+	var profile oidcClaims
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	err = json.Unmarshal(encoded, &profile)
+	return profile, err
+}
+
+// Exchange reads the profile from the verified ID token, the userinfo endpoint only fills in
+// claims the ID token left out. Verification comes from the ID token alone, providers like
+// Entra ID don't say anything about it in userinfo.
+func (p *oidcProvider) Exchange(ctx context.Context, code string) (structs.ProviderProfile, error) {
+	token, err := p.conf.Exchange(ctx, code)
+	if err != nil {
+		return structs.ProviderProfile{}, err
+	}
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return structs.ProviderProfile{}, fmt.Errorf("%s returned no ID token", p.name)
+	}
+	claims, err := p.verifyIDToken(raw)
+	if err != nil {
+		return structs.ProviderProfile{}, err
+	}
+
+	var info oidcClaims
+	if err := getJSON(p.conf.Client(ctx, token), p.userinfoURL, &info); err != nil {
+		return structs.ProviderProfile{}, err
+	}
+	if info.Subject != claims.Subject {
+		return structs.ProviderProfile{}, fmt.Errorf("%s userinfo is for a different subject than the ID token", p.name)
+	}
+	fill := func(claim *string, fallback string) {
+		if *claim == "" {
+			*claim = fallback
+		}
+	}
+	verified := claimTrue(claims.EmailVerified) || claimTrue(claims.DomainVerified)
+	if claims.Email == "" {
+		claims.Email = info.Email
+		verified = claimTrue(info.EmailVerified)
+	}
+	fill(&claims.Name, info.Name)
+	fill(&claims.GivenName, info.GivenName)
+	fill(&claims.FamilyName, info.FamilyName)
+	fill(&claims.Picture, info.Picture)
+	fill(&claims.Locale, info.Locale)
+
+	return structs.ProviderProfile{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: verified,
+		Name:          claims.Name,
+		GivenName:     claims.GivenName,
+		FamilyName:    claims.FamilyName,
+		Picture:       claims.Picture,
+		Locale:        claims.Locale,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	jtoken "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCallbackURL tests that providers derive their callback from the Google one unless overridden
+func TestCallbackURL(t *testing.T) {
+	t.Setenv("REDIRECT_URL", "https://api.example.com/auth/google/callback")
+	t.Setenv("GITHUB_REDIRECT_URL", "")
+	t.Setenv("OKTA_REDIRECT_URL", "https://sso.example.com/auth/okta/callback")
+
+	assert.Equal(t, "https://api.example.com/auth/google/callback", callbackURL("google"))
+	assert.Equal(t, "https://api.example.com/auth/github/callback", callbackURL("github"))
+	assert.Equal(t, "https://sso.example.com/auth/okta/callback", callbackURL("okta"))
+}
+
+// oidcTestServer serves discovery, keys, tokens and userinfo for an OIDC provider whose ID
+// tokens carry idClaims and whose userinfo endpoint returns userinfo. {server} in the issuer and
+// claims is replaced with the server's URL.
+func oidcTestServer(t *testing.T, issuer string, idClaims jtoken.MapClaims, userinfo map[string]interface{}) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 strings.Replace(issuer, "{server}", server.URL, 1),
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"userinfo_endpoint":      server.URL + "/userinfo",
+			"jwks_uri":               server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		claims := jtoken.MapClaims{
+			"iss": server.URL,
+			"aud": "client",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for name, value := range idClaims {
+			if value, ok := value.(string); ok {
+				claims[name] = strings.Replace(value, "{server}", server.URL, 1)
+				continue
+			}
+			claims[name] = value
+		}
+		token := jtoken.NewWithClaims(jtoken.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "token_type": "Bearer", "id_token": idToken})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(userinfo)
+	})
+	return server
+}
+
+// TestOIDCProvider tests that OIDC providers are set up from discovery and read the verified ID token
+func TestOIDCProvider(t *testing.T) {
+	server := oidcTestServer(t, "{server}", jtoken.MapClaims{
+		"sub":            "subject",
+		"email":          "user@example.com",
+		"email_verified": "true",
+	}, map[string]interface{}{
+		"sub":  "subject",
+		"name": "User",
+	})
+
+	t.Setenv("REDIRECT_URL", "https://api.example.com/auth/google/callback")
+	provider, err := newOIDCProvider(context.Background(), "okta", server.URL+"/", "client", "secret", []string{"email"})
+	assert.NoError(t, err)
+	assert.Equal(t, "okta", provider.Name())
+	assert.Contains(t, provider.AuthCodeURL("state"), server.URL+"/authorize?")
+	assert.Contains(t, provider.AuthCodeURL("state"), "scope=openid+email")
+	assert.Contains(t, provider.AuthCodeURL("state"), "redirect_uri=https%3A%2F%2Fapi.example.com%2Fauth%2Fokta%2Fcallback")
+
+	profile, err := provider.Exchange(context.Background(), "code")
+	assert.NoError(t, err)
+	assert.Equal(t, "subject", profile.Subject)
+	assert.Equal(t, "user@example.com", profile.Email)
+	assert.True(t, profile.EmailVerified)
+	assert.Equal(t, "User", profile.Name)
+}
+
+// TestOIDCProviderMicrosoft tests that Entra ID sign ins, whose userinfo never says whether the
+// email is verified, give a usable profile when the ID token says the domain is verified
+func TestOIDCProviderMicrosoft(t *testing.T) {
+	userinfo := map[string]interface{}{
+		"sub":         "entra-subject",
+		"name":        "Ada Lovelace",
+		"given_name":  "Ada",
+		"family_name": "Lovelace",
+		"email":       "ada@contoso.com",
+		"picture":     "https://graph.microsoft.com/v1.0/me/photo/$value",
+	}
+	server := oidcTestServer(t, "{server}/{tenantid}/v2.0", jtoken.MapClaims{
+		"iss":      "{server}/tenant/v2.0",
+		"sub":      "entra-subject",
+		"tid":      "tenant",
+		"email":    "ada@contoso.com",
+		"xms_edov": true,
+	}, userinfo)
+
+	provider, err := newOIDCProvider(context.Background(), "microsoft", server.URL, "client", "secret", []string{"email", "profile"})
+	assert.NoError(t, err)
+
+	profile, err := provider.Exchange(context.Background(), "code")
+	assert.NoError(t, err)
+	assert.Equal(t, structs.ProviderProfile{
+		Subject:       "entra-subject",
+		Email:         "ada@contoso.com",
+		EmailVerified: true,
+		Name:          "Ada Lovelace",
+		GivenName:     "Ada",
+		FamilyName:    "Lovelace",
+		Picture:       "https://graph.microsoft.com/v1.0/me/photo/$value",
+	}, profile)
+}
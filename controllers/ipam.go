@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	structs "zeroshare-backend/structs"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Key for pg_advisory_xact_lock so allocations are serialised across backend instances
+const ipamLockKey = 4242
+
+// The lowest free address is either the first one in the pool or the one right after
+// an address that is already allocated or reserved.
+const freeIPQuery = `
+SELECT MIN(candidate) FROM (
+	SELECT CAST(? AS bigint) AS candidate
+	UNION SELECT ip_int + 1 FROM ip_allocations
+	UNION SELECT end_ip + 1 FROM ip_reservations
+) c
+WHERE candidate BETWEEN ? AND ?
+AND NOT EXISTS (SELECT 1 FROM ip_allocations a WHERE a.ip_int = c.candidate)
+AND NOT EXISTS (SELECT 1 FROM ip_reservations r WHERE c.candidate BETWEEN r.start_ip AND r.end_ip)`
+
+type IPPoolExhaustedError struct {
+	Network string
+}
+
+func (e *IPPoolExhaustedError) Error() string {
+	return fmt.Sprintf("no free addresses left in %s", e.Network)
+}
+
+func InitIPAM(db *gorm.DB) {
+	for _, lighthouse := range networkConfig.Lighthouses {
+		if err := ReserveIPRange(db, lighthouse.Ip, lighthouse.Ip, "lighthouse"); err != nil {
+			log.Panic(err)
+		}
+	}
+	for _, reserved := range networkConfig.Reserved {
+		start, end, _ := networkConfig.reservedRange(reserved)
+		if err := ReserveIPRange(db, start, end, "config"); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	// Backfill devices that were given an address before the allocator existed
+	var devices []structs.Device
+	if err := db.Where("ip_address IS NOT NULL AND ip_address <> ''").Find(&devices).Error; err != nil {
+		log.Panic(err)
+	}
+	for _, device := range devices {
+		ip := net.ParseIP(device.IpAddress).To4()
+		if ip == nil || !networkConfig.Network().Contains(ip) {
+			log.Printf("InitIPAM: skipping device %s with address %q outside %s", device.ID, device.IpAddress, networkConfig.Network())
+			continue
+		}
+		allocation := structs.IpAllocation{IpInt: ipToInt(ip), IpAddress: ip.String(), DeviceId: device.ID}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&allocation).Error; err != nil {
+			log.Printf("InitIPAM: failed to backfill %s: %v", device.IpAddress, err)
+		}
+	}
+}
+
+// AllocateIP returns the overlay address of the device, assigning the lowest free one if it has none yet.
+func AllocateIP(db *gorm.DB, deviceID uuid.UUID) (net.IP, error) {
+	var ip net.IP
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", ipamLockKey).Error; err != nil {
+			return err
+		}
+
+		var existing structs.IpAllocation
+		err := tx.Where("device_id = ?", deviceID).First(&existing).Error
+		if err == nil {
+			ip = intToIP(existing.IpInt)
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		first, last := poolBounds()
+		var candidate sql.NullInt64
+		if err := tx.Raw(freeIPQuery, first, first, last).Row().Scan(&candidate); err != nil {
+			return err
+		}
+		if !candidate.Valid {
+			return &IPPoolExhaustedError{Network: networkConfig.Network().String()}
+		}
+
+		ip = intToIP(candidate.Int64)
+		allocation := structs.IpAllocation{IpInt: candidate.Int64, IpAddress: ip.String(), DeviceId: deviceID}
+		if err := tx.Create(&allocation).Error; err != nil {
+			return err
+		}
+		return tx.Model(&structs.Device{}).Where("id = ?", deviceID).Update("ip_address", ip.String()).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// ReleaseIP returns the device's address to the pool so it can be handed out again.
+func ReleaseIP(db *gorm.DB, deviceID uuid.UUID) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", ipamLockKey).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("device_id = ?", deviceID).Delete(&structs.IpAllocation{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&structs.Device{}).Where("id = ?", deviceID).Update("ip_address", "").Error
+	})
+}
+
+// ReserveIPRange keeps the inclusive range start-end from ever being allocated.
+func ReserveIPRange(db *gorm.DB, start string, end string, reason string) error {
+	startIP := net.ParseIP(start).To4()
+	endIP := net.ParseIP(end).To4()
+	if startIP == nil || endIP == nil || !networkConfig.Network().Contains(startIP) || !networkConfig.Network().Contains(endIP) {
+		return fmt.Errorf("reserved range %s-%s is not inside %s", start, end, networkConfig.Network())
+	}
+	if ipToInt(startIP) > ipToInt(endIP) {
+		return fmt.Errorf("reserved range %s-%s is inverted", start, end)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", ipamLockKey).Error; err != nil {
+			return err
+		}
+
+		var allocated int64
+		if err := tx.Model(&structs.IpAllocation{}).Where("ip_int BETWEEN ? AND ?", ipToInt(startIP), ipToInt(endIP)).Count(&allocated).Error; err != nil {
+			return err
+		}
+		if allocated > 0 {
+			return fmt.Errorf("reserved range %s-%s overlaps %d allocated addresses", start, end, allocated)
+		}
+
+		reservation := structs.IpReservation{
+			StartIp: ipToInt(startIP),
+			EndIp:   ipToInt(endIP),
+			Start:   startIP.String(),
+			End:     endIP.String(),
+			Reason:  reason,
+		}
+		return tx.Where(structs.IpReservation{StartIp: reservation.StartIp, EndIp: reservation.EndIp}).FirstOrCreate(&reservation).Error
+	})
+}
+
+// IPPoolStatus reports how much of the pool is allocated, reserved and still free
+func IPPoolStatus(db *gorm.DB) (structs.IpPoolStatus, error) {
+	first, last := poolBounds()
+	status := structs.IpPoolStatus{
+		Network: networkConfig.Network().String(),
+		First:   intToIP(first).String(),
+		Last:    intToIP(last).String(),
+		Size:    last - first + 1,
+	}
+
+	if err := db.Model(&structs.IpAllocation{}).Where("ip_int BETWEEN ? AND ?", first, last).Count(&status.Allocated).Error; err != nil {
+		return status, err
+	}
+	if err := db.Order("start_ip").Find(&status.Reservations).Error; err != nil {
+		return status, err
+	}
+	status.Reserved = reservedAddresses(status.Reservations, first, last)
+	status.Free = status.Size - status.Allocated - status.Reserved
+	return status, nil
+}
+
+// reservedAddresses counts the addresses in first-last covered by reservations sorted by start,
+// counting overlapping reservations once
+func reservedAddresses(reservations []structs.IpReservation, first int64, last int64) int64 {
+	var count int64
+	next := first
+	for _, reservation := range reservations {
+		start, end := max(reservation.StartIp, next), min(reservation.EndIp, last)
+		if start <= end {
+			count += end - start + 1
+			next = end + 1
+		}
+	}
+	return count
+}
+
+// First and last usable host addresses of the overlay network, skipping the network and broadcast addresses
+func poolBounds() (int64, int64) {
+	ones, bits := networkConfig.Network().Mask.Size()
+	base := ipToInt(networkConfig.Network().IP)
+	return base + 1, base + (int64(1) << (bits - ones)) - 2
+}
+
+func ipToInt(ip net.IP) int64 {
+	return int64(binary.BigEndian.Uint32(ip.To4()))
+}
+
+func intToIP(n int64) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, uint32(n))
+	return ip
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"net"
+	"testing"
+	structs "zeroshare-backend/structs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPoolBounds tests that the network and broadcast addresses are never handed out
+func TestPoolBounds(t *testing.T) {
+	first, last := poolBounds()
+	assert.Equal(t, "42.0.0.1", intToIP(first).String())
+	assert.Equal(t, "42.255.255.254", intToIP(last).String())
+}
+
+// TestIPIntRoundTrip tests the conversion between addresses and their integer form
+func TestIPIntRoundTrip(t *testing.T) {
+	ip := net.ParseIP("42.1.2.3")
+	assert.Equal(t, int64(0x2a010203), ipToInt(ip))
+	assert.Equal(t, "42.1.2.3", intToIP(ipToInt(ip)).String())
+}
+
+// TestReservedAddresses tests that overlapping and out of pool reservations are counted once
+func TestReservedAddresses(t *testing.T) {
+	reservations := []structs.IpReservation{
+		{StartIp: 5, EndIp: 5},
+		{StartIp: 10, EndIp: 20},
+		{StartIp: 15, EndIp: 25},
+		{StartIp: 95, EndIp: 120},
+	}
+	assert.Equal(t, int64(1+16+6), reservedAddresses(reservations, 1, 100))
+	assert.Equal(t, int64(0), reservedAddresses(nil, 1, 100))
+}
@@ -0,0 +1,308 @@
+package controllers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	jtoken "github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Key for pg_advisory_xact_lock so only one instance creates or rotates signing keys at a time
+const jwtKeysLockKey = 4243
+
+const (
+	// How often instances pick up keys rotated by another instance
+	jwtKeysReloadInterval = 5 * time.Minute
+	// Unknown kids trigger a reload, but no more often than this
+	jwtKeysMissReloadInterval = 10 * time.Second
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+// jwtKeyGrace is how long a rotated out key keeps verifying tokens, JWT_KEY_GRACE overrides the
+// default of one access token lifetime
+func jwtKeyGrace() time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("JWT_KEY_GRACE")); err == nil && grace > 0 {
+		return grace
+	}
+	return accessTokenTTL
+}
+
+type signingKey struct {
+	kid       string
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+	expiresAt int64
+}
+
+// keyring caches the signing keys stored in Postgres
+type keyring struct {
+	mu     sync.RWMutex
+	db     *gorm.DB
+	active *signingKey
+	keys   map[string]*signingKey
+	loaded time.Time
+	// HS256 tokens signed with AUTH_SECRET from before the keyring existed are accepted until then
+	legacyUntil time.Time
+}
+
+var jwtKeys = &keyring{}
+
+// InitJWTKeys loads the keyring, creating its first key on a fresh install
+func InitJWTKeys(db *gorm.DB) {
+	jwtKeys.db = db
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", jwtKeysLockKey).Error; err != nil {
+			return err
+		}
+		var active int64
+		if err := tx.Model(&structs.SigningKey{}).Where("retired_at IS NULL").Count(&active).Error; err != nil {
+			return err
+		}
+		if active > 0 {
+			return nil
+		}
+		_, err := createSigningKey(tx)
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := jwtKeys.load(); err != nil {
+		log.Panic(err)
+	}
+}
+
+// RotateJWTKey retires the signing key and starts signing with a new one. The old key keeps
+// verifying tokens for the grace period.
+func RotateJWTKey(db *gorm.DB) (structs.SigningKey, error) {
+	var key structs.SigningKey
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", jwtKeysLockKey).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		err := tx.Model(&structs.SigningKey{}).Where("retired_at IS NULL").Updates(map[string]interface{}{
+			"retired_at": now.Unix(),
+			"expires_at": now.Add(jwtKeyGrace()).Unix(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		key, err = createSigningKey(tx)
+		return err
+	})
+	if err != nil {
+		return key, err
+	}
+	return key, jwtKeys.load()
+}
+
+func createSigningKey(db *gorm.DB) (structs.SigningKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return structs.SigningKey{}, err
+	}
+	sealed, err := sealSigningKey(private)
+	if err != nil {
+		return structs.SigningKey{}, err
+	}
+	key := structs.SigningKey{
+		Kid:        jwkThumbprint(public),
+		Algorithm:  jtoken.SigningMethodEdDSA.Alg(),
+		PublicKey:  public,
+		PrivateKey: sealed,
+	}
+	return key, db.Create(&key).Error
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of an Ed25519 public key, used as its kid
+func jwkThumbprint(public ed25519.PublicKey) string {
+	members := fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, base64.RawURLEncoding.EncodeToString(public))
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Private keys are stored encrypted with a key derived from AUTH_SECRET, so a database dump alone
+// can't mint tokens. Changing AUTH_SECRET means rotating in a new key and logging everyone out.
+func signingKeyCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("jwt-signing-key:" + os.Getenv("AUTH_SECRET")))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealSigningKey(private ed25519.PrivateKey) ([]byte, error) {
+	aead, err := signingKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, private.Seed(), nil), nil
+}
+
+func openSigningKey(sealed []byte) (ed25519.PrivateKey, error) {
+	aead, err := signingKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed signing key is too short")
+	}
+	seed, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// load replaces the cached keys with the ones in the database that still verify
+func (k *keyring) load() error {
+	var stored []structs.SigningKey
+	err := k.db.Where("expires_at IS NULL OR expires_at > ?", time.Now().Unix()).Order("created ASC").Find(&stored).Error
+	if err != nil {
+		return err
+	}
+	var oldest structs.SigningKey
+	if err := k.db.Order("created ASC").First(&oldest).Error; err != nil {
+		return err
+	}
+
+	keys := map[string]*signingKey{}
+	var active *signingKey
+	for _, key := range stored {
+		loaded := &signingKey{kid: key.Kid, public: ed25519.PublicKey(key.PublicKey)}
+		if key.ExpiresAt != nil {
+			loaded.expiresAt = *key.ExpiresAt
+		}
+		if key.RetiredAt == nil {
+			if loaded.private, err = openSigningKey(key.PrivateKey); err != nil {
+				return fmt.Errorf("failed to decrypt signing key %s: %w", key.Kid, err)
+			}
+			active = loaded
+		}
+		keys[key.Kid] = loaded
+	}
+	if active == nil {
+		return errors.New("no active signing key")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.active, k.loaded = keys, active, time.Now()
+	k.legacyUntil = time.Unix(oldest.Created, 0).Add(accessTokenTTL)
+	return nil
+}
+
+// reloadIfOlder reloads the keys when they were loaded longer than age ago
+func (k *keyring) reloadIfOlder(age time.Duration) {
+	k.mu.RLock()
+	stale := time.Since(k.loaded) > age
+	k.mu.RUnlock()
+	if stale {
+		if err := k.load(); err != nil {
+			log.Println("Failed to reload signing keys:", err)
+		}
+	}
+}
+
+func (k *keyring) lookup(kid string) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key := k.keys[kid]
+	if key == nil || (key.expiresAt != 0 && key.expiresAt < time.Now().Unix()) {
+		return nil
+	}
+	return key
+}
+
+// signJWT signs claims with the active key and names it in the kid header
+func signJWT(claims jtoken.Claims) (string, error) {
+	jwtKeys.reloadIfOlder(jwtKeysReloadInterval)
+	jwtKeys.mu.RLock()
+	key := jwtKeys.active
+	jwtKeys.mu.RUnlock()
+
+	token := jtoken.NewWithClaims(jtoken.SigningMethodEdDSA, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// JWTKeyfunc verifies tokens against the keyring
+func JWTKeyfunc(token *jtoken.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jtoken.SigningMethodHMAC); ok {
+		if _, hasKid := token.Header["kid"]; !hasKid && time.Now().Before(jwtKeys.legacyUntil) {
+			return []byte(os.Getenv("AUTH_SECRET")), nil
+		}
+		return nil, errors.New("unexpected signing method")
+	}
+	if _, ok := token.Method.(*jtoken.SigningMethodEd25519); !ok {
+		return nil, errors.New("unexpected signing method")
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key := jwtKeys.lookup(kid)
+	if key == nil {
+		// Might have been created by another instance since the last load
+		jwtKeys.reloadIfOlder(jwtKeysMissReloadInterval)
+		key = jwtKeys.lookup(kid)
+	}
+	if key == nil {
+		return nil, ErrUnknownSigningKey
+	}
+	return key.public, nil
+}
+
+// JWKS publishes the public keys tokens can currently be verified with
+func JWKS(c *fiber.Ctx) error {
+	jwtKeys.reloadIfOlder(jwtKeysReloadInterval)
+	jwtKeys.mu.RLock()
+	defer jwtKeys.mu.RUnlock()
+
+	now := time.Now().Unix()
+	jwks := structs.JWKS{Keys: []structs.JWK{}}
+	for _, key := range jwtKeys.keys {
+		if key.expiresAt != 0 && key.expiresAt < now {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, structs.JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.public),
+			Kid: key.kid,
+			Alg: jtoken.SigningMethodEdDSA.Alg(),
+			Use: "sig",
+		})
+	}
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(jwks)
+}
+
+// ListJWTKeys shows admins the keyring without the private keys
+func ListJWTKeys(c *fiber.Ctx, db *gorm.DB) error {
+	var keys []structs.SigningKey
+	if err := db.Order("created DESC").Find(&keys).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(keys)
+}
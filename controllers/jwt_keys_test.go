@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	jtoken "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestJWKThumbprint tests the kid against the example key from RFC 8037
+func TestJWKThumbprint(t *testing.T) {
+	public, err := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	assert.NoError(t, err)
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", jwkThumbprint(public))
+}
+
+// TestSealSigningKey tests that private keys only open with the AUTH_SECRET they were sealed with
+func TestSealSigningKey(t *testing.T) {
+	t.Setenv("AUTH_SECRET", "test-secret")
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	sealed, err := sealSigningKey(private)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), string(private.Seed()))
+
+	opened, err := openSigningKey(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, private, opened)
+
+	t.Setenv("AUTH_SECRET", "other-secret")
+	_, err = openSigningKey(sealed)
+	assert.Error(t, err)
+}
+
+// TestJWTKeyfunc tests that tokens verify against active and retired keys until they expire
+func TestJWTKeyfunc(t *testing.T) {
+	t.Setenv("AUTH_SECRET", "test-secret")
+	defer func(saved *keyring) { jwtKeys = saved }(jwtKeys)
+
+	newKey := func(expiresAt int64) *signingKey {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		return &signingKey{kid: jwkThumbprint(public), public: public, private: private, expiresAt: expiresAt}
+	}
+	active := newKey(0)
+	retired := newKey(time.Now().Add(time.Hour).Unix())
+	expired := newKey(time.Now().Add(-time.Hour).Unix())
+	jwtKeys = &keyring{
+		active:      active,
+		keys:        map[string]*signingKey{active.kid: active, retired.kid: retired, expired.kid: expired},
+		loaded:      time.Now(),
+		legacyUntil: time.Now().Add(time.Hour),
+	}
+
+	claims := jtoken.MapClaims{"ID": "c0ffee00-0000-0000-0000-000000000000", "exp": time.Now().Add(time.Hour).Unix()}
+	signWith := func(key *signingKey) string {
+		token := jtoken.NewWithClaims(jtoken.SigningMethodEdDSA, claims)
+		token.Header["kid"] = key.kid
+		signed, err := token.SignedString(key.private)
+		assert.NoError(t, err)
+		return signed
+	}
+	hmac := func(kid string) string {
+		token := jtoken.NewWithClaims(jtoken.SigningMethodHS256, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString([]byte("test-secret"))
+		assert.NoError(t, err)
+		return signed
+	}
+
+	signed, err := signJWT(claims)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"active key", signed, true},
+		{"retired key in grace period", signWith(retired), true},
+		{"expired key", signWith(expired), false},
+		{"unknown key", signWith(newKey(0)), false},
+		{"legacy hs256", hmac(""), true},
+		{"hs256 with kid", hmac(active.kid), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := jtoken.Parse(tt.token, JWTKeyfunc)
+			if tt.valid {
+				assert.NoError(t, err)
+				assert.True(t, token.Valid)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	jwtKeys.legacyUntil = time.Now().Add(-time.Second)
+	_, err = jtoken.Parse(hmac(""), JWTKeyfunc)
+	assert.Error(t, err, "legacy hs256 after the cutoff")
+}
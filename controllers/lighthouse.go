@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
+)
+
+const defaultLighthouseConfigPath = "./config/config.yml"
+
+// Serialises rewrites of the lighthouse config within this process
+var lighthouseConfigMu sync.Mutex
+
+func lighthouseConfigPath() string {
+	if path := os.Getenv("LIGHTHOUSE_CONFIG_PATH"); path != "" {
+		return path
+	}
+	return defaultLighthouseConfigPath
+}
+
+// mergeLighthouseConfig replaces the given keys under section (e.g. "pki") in the lighthouse
+// config.yml, leaving the rest of the file and its comments untouched. start-lighthouse.sh sends
+// the lighthouse a SIGHUP when the file changes, which makes it reload.
+func mergeLighthouseConfig(section string, values map[string]interface{}) error {
+	lighthouseConfigMu.Lock()
+	defer lighthouseConfigMu.Unlock()
+
+	path := lighthouseConfigPath()
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read lighthouse config: %v", err)
+	}
+
+	file, err := parser.ParseBytes(src, parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("failed to parse lighthouse config: %v", err)
+	}
+
+	sectionPath, err := yaml.PathString("$." + section)
+	if err != nil {
+		return err
+	}
+
+	patch, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	if err := sectionPath.MergeFromReader(file, bytes.NewReader(patch)); err != nil {
+		return fmt.Errorf("failed to update %s in lighthouse config: %v", section, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(file.String()), info.Mode())
+}
@@ -29,7 +29,7 @@ func InitSlog(logProvider log.LoggerProvider) (*slog.Logger, slogfiber.Config) {
 		WithResponseHeader: false,
 		Filters: []slogfiber.Filter{
 			slogfiber.IgnoreStatus(401, 404),
-			slogfiber.IgnorePathContains("/oauth/google", "/auth/google/callback", "/refresh"),
+			slogfiber.IgnorePathContains("/oauth/google", "/callback", "/refresh"),
 		},
 	}
 
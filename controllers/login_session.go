@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Login sessions are issued by the server and bound to a PKCE challenge, so only the client that
+// started one can collect its tokens at /sse/:sessionToken
+const loginSessionTTL = 10 * time.Minute
+
+// Set on the browser that starts an OAuth sign in, the callback must come back to the same browser
+const loginStateCookie = "login_state"
+
+var (
+	ErrUnknownLoginSession = errors.New("unknown or expired login session")
+	ErrInvalidCodeVerifier = errors.New("code verifier does not match")
+	ErrLoginSessionClaimed = errors.New("login session has already been used")
+	ErrLoginStateMismatch  = errors.New("sign in finished in a different browser than it started in")
+)
+
+func loginSessionKey(sessionToken string) string {
+	return "login-session:" + sessionToken
+}
+
+func oauthStateKey(state string) string {
+	return "oauth-state:" + state
+}
+
+// pkceChallenge is the S256 challenge for a verifier, RFC 7636
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CreateLoginSession issues a session token for a client that holds the verifier to the challenge
+func CreateLoginSession(c *fiber.Ctx, redisStore *redis.Client) error {
+	body := new(structs.LoginSessionRequest)
+	if err := c.BodyParser(body); err != nil || body.CodeChallenge == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code_challenge is required",
+		})
+	}
+	if body.CodeChallengeMethod != "S256" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code_challenge_method must be S256",
+		})
+	}
+	// A base64url encoded SHA-256 hash
+	if decoded, err := base64.RawURLEncoding.DecodeString(body.CodeChallenge); err != nil || len(decoded) != sha256.Size {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid code_challenge",
+		})
+	}
+
+	sessionToken, err := newRefreshToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create login session",
+		})
+	}
+	ctx := c.Context()
+	key := loginSessionKey(sessionToken)
+	_, err = redisStore.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"challenge", body.CodeChallenge,
+			"created", time.Now().Unix(),
+		)
+		pipe.Expire(ctx, key, loginSessionTTL)
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create login session",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(structs.LoginSessionResponse{
+		SessionToken: sessionToken,
+		ExpiresIn:    int(loginSessionTTL.Seconds()),
+	})
+}
+
+// loginSessionExists is checked before a sign in is started for a session token
+func loginSessionExists(ctx context.Context, redisStore *redis.Client, sessionToken string) bool {
+	exists, err := redisStore.Exists(ctx, loginSessionKey(sessionToken)).Result()
+	return err == nil && exists > 0
+}
+
+// claimLoginSession checks the verifier and lets only one stream wait for the session's tokens
+func claimLoginSession(ctx context.Context, redisStore *redis.Client, sessionToken string, verifier string) error {
+	key := loginSessionKey(sessionToken)
+	challenge, err := redisStore.HGet(ctx, key, "challenge").Result()
+	if errors.Is(err, redis.Nil) {
+		return ErrUnknownLoginSession
+	}
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(challenge)) != 1 {
+		return ErrInvalidCodeVerifier
+	}
+	claimed, err := redisStore.HSetNX(ctx, key, "claimed", time.Now().Unix()).Result()
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrLoginSessionClaimed
+	}
+	return nil
+}
+
+// LoginSessionStream checks the caller holds the session's verifier before streaming its tokens.
+// EventSource can't set headers, so the verifier may come as a query parameter.
+func LoginSessionStream(c *fiber.Ctx, redisStore *redis.Client) error {
+	sessionToken := c.Params("sessionToken")
+	verifier := c.Get("X-Code-Verifier", c.Query("code_verifier"))
+	err := claimLoginSession(c.Context(), redisStore, sessionToken, verifier)
+	switch {
+	case errors.Is(err, ErrUnknownLoginSession):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown or expired login session",
+		})
+	case errors.Is(err, ErrInvalidCodeVerifier):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code verifier",
+		})
+	case errors.Is(err, ErrLoginSessionClaimed):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Login session is already being waited on",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to open login session",
+		})
+	}
+	return SSE(c, redisStore, sessionToken)
+}
+
+// takeLoginSessionTokens returns tokens that were published before the stream subscribed and
+// ends the session
+func takeLoginSessionTokens(ctx context.Context, redisStore *redis.Client, sessionToken string) (string, bool) {
+	tokens, err := redisStore.HGet(ctx, loginSessionKey(sessionToken), "tokens").Result()
+	if err != nil {
+		return "", false
+	}
+	redisStore.Del(ctx, loginSessionKey(sessionToken))
+	return tokens, true
+}
+
+// completeLoginSession reserves a login session for the sign in about to finish, only the first
+// one counts
+func completeLoginSession(ctx context.Context, redisStore *redis.Client, sessionToken string) error {
+	key := loginSessionKey(sessionToken)
+	completed, err := redisStore.HSetNX(ctx, key, "completed", time.Now().Unix()).Result()
+	if err != nil {
+		return err
+	}
+	if !completed {
+		return ErrLoginSessionClaimed
+	}
+	// HSETNX creates the hash if the session had already expired
+	if exists, err := redisStore.HExists(ctx, key, "challenge").Result(); err != nil || !exists {
+		redisStore.Del(ctx, key)
+		return ErrUnknownLoginSession
+	}
+	return nil
+}
+
+// publishTokens hands a completed login session its tokens. They are kept with the session in
+// case its stream isn't subscribed yet.
+func publishTokens(redisStore *redis.Client, sessionToken string, tokenResponse structs.TokenResponse) error {
+	ctx := context.Background()
+	jsonData, err := json.Marshal(tokenResponse)
+	if err != nil {
+		return err
+	}
+	if err := redisStore.HSet(ctx, loginSessionKey(sessionToken), "tokens", jsonData).Err(); err != nil {
+		return err
+	}
+	return redisStore.Publish(ctx, sessionToken, jsonData).Err()
+}
+
+// startOAuthLogin picks a fresh OAuth state for a login session, the session token itself never
+// goes to the provider. The state is also set as a cookie the callback checks, so a callback
+// can't be replayed in another browser.
+func startOAuthLogin(c *fiber.Ctx, redisStore *redis.Client, sessionToken string) (string, error) {
+	if !loginSessionExists(c.Context(), redisStore, sessionToken) {
+		return "", ErrUnknownLoginSession
+	}
+	state, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	if err := redisStore.Set(c.Context(), oauthStateKey(state), sessionToken, loginSessionTTL).Err(); err != nil {
+		return "", err
+	}
+	setStateCookie(c, loginStateCookie, state, loginSessionTTL)
+	return state, nil
+}
+
+// setStateCookie binds an OAuth state to the browser, only callbacks under /auth/ see it
+func setStateCookie(c *fiber.Ctx, name string, state string, ttl time.Duration) {
+	c.Cookie(&fiber.Cookie{
+		Name:     name,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// checkStateCookie clears the state cookie and reports whether it matched the callback's state
+func checkStateCookie(c *fiber.Ctx, name string, state string) bool {
+	cookie := c.Cookies(name)
+	c.Cookie(&fiber.Cookie{
+		Name:    name,
+		Path:    "/auth/",
+		Expires: time.Now().Add(-time.Hour),
+	})
+	return cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) == 1
+}
+
+// finishOAuthLogin returns the login session an OAuth state was issued for. States are single use.
+func finishOAuthLogin(c *fiber.Ctx, redisStore *redis.Client, state string) (string, error) {
+	sessionToken, err := redisStore.GetDel(c.Context(), oauthStateKey(state)).Result()
+	if err != nil {
+		return "", ErrUnknownLoginSession
+	}
+	if !checkStateCookie(c, loginStateCookie, state) {
+		return "", ErrLoginStateMismatch
+	}
+	return sessionToken, nil
+}
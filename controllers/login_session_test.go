@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPKCEChallenge tests the S256 challenge against the example in RFC 7636 appendix B
+func TestPKCEChallenge(t *testing.T) {
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
+
+// TestCreateLoginSessionValidation tests that login sessions need an S256 challenge
+func TestCreateLoginSessionValidation(t *testing.T) {
+	app := fiber.New()
+	app.Post("/login/session", func(c *fiber.Ctx) error {
+		return CreateLoginSession(c, nil)
+	})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "missing challenge", body: `{"code_challenge_method":"S256"}`},
+		{name: "plain method", body: `{"code_challenge":"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM","code_challenge_method":"plain"}`},
+		{name: "not a hash", body: `{"code_challenge":"short","code_challenge_method":"S256"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/login/session", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+// TestCheckStateCookie tests that OAuth callbacks only go through in the browser holding the
+// state's cookie, and that the cookie is cleared either way
+func TestCheckStateCookie(t *testing.T) {
+	app := fiber.New()
+	app.Get("/auth/github/callback", func(c *fiber.Ctx) error {
+		if !checkStateCookie(c, linkStateCookie, c.Query("state")) {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		cookie string
+		status int
+	}{
+		{name: "same browser", cookie: "state", status: fiber.StatusOK},
+		{name: "other state", cookie: "other", status: fiber.StatusForbidden},
+		{name: "no cookie", status: fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth/github/callback?state=state", nil)
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", linkStateCookie+"="+tt.cookie)
+			}
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, resp.StatusCode)
+			assert.Contains(t, resp.Header.Get("Set-Cookie"), linkStateCookie+"=;")
+		})
+	}
+}
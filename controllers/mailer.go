@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailMessage is a plain text email
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails, e.g. sign in codes
+type Mailer interface {
+	Send(ctx context.Context, message MailMessage) error
+}
+
+var mailer Mailer = logMailer{}
+
+// InitMailer picks the mailer from MAILER: smtp, file or log. It defaults to smtp when SMTP_HOST
+// is set and to log otherwise, which prints emails to the backend's log.
+func InitMailer() {
+	kind := os.Getenv("MAILER")
+	if kind == "" && os.Getenv("SMTP_HOST") != "" {
+		kind = "smtp"
+	}
+	switch kind {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		mailer = &smtpMailer{
+			addr:     net.JoinHostPort(os.Getenv("SMTP_HOST"), port),
+			host:     os.Getenv("SMTP_HOST"),
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     os.Getenv("SMTP_FROM"),
+		}
+	case "file":
+		mailer = &fileMailer{path: os.Getenv("MAILER_FILE")}
+	default:
+		log.Println("No mailer configured, emails are written to the log")
+		mailer = logMailer{}
+	}
+}
+
+// formatMail renders a message with the headers every mailer writes
+func formatMail(from string, message MailMessage) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, message.To, message.Subject, time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(message.Body, "\n", "\r\n")))
+}
+
+// smtpMailer sends through an SMTP relay, upgrading to TLS with STARTTLS when the server offers it
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, message MailMessage) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{message.To}, formatMail(m.from, message))
+}
+
+// fileMailer appends emails to a file, for tests and trying out a deployment
+type fileMailer struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (m *fileMailer) Send(ctx context.Context, message MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	file, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(formatMail("zeroshare", message), '\n'))
+	return err
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, message MailMessage) error {
+	log.Printf("Email to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
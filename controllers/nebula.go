@@ -4,135 +4,171 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	structs "zeroshare-backend/structs"
 
 	"github.com/google/uuid"
+	"github.com/slackhq/nebula/cert"
 	"gorm.io/gorm"
 )
 
-var nebulaCertPath string
-
-func init() {
-	nebulaCertPath = os.Getenv("NEBULA_CERT_PATH")
-	if nebulaCertPath == "" {
-		nebulaCertPath = "/usr/local/bin/nebula-cert" // fallback default
-	}
-}
-
-func InitNebula(ctx context.Context) {
-	// Paths to the CA certificate and key files
-	caCrtPath := "./certs/ca.crt"
-	caKeyPath := "./certs/ca.key"
+const (
+	caCrtPath = "./certs/ca.crt"
+	caKeyPath = "./certs/ca.key"
+)
 
+func InitNebula(ctx context.Context, db *gorm.DB) {
 	log.Printf("InitNebula")
 
-	// Check if both files exist
-	if !fileExists(caCrtPath) || !fileExists(caKeyPath) {
+	if caKeyStore == nil {
+		store, err := caKeyStoreFromEnv()
+		if err != nil {
+			log.Panic(err)
+		}
+		caKeyStore = store
+	}
+
+	// Check if both the cert and key exist, only the file backend keeps the key next to the cert
+	_, fileBacked := caKeyStore.(*fileKeyStore)
+	if !fileExists(caCrtPath) || (fileBacked && !fileExists(caKeyPath)) {
 		log.Printf("InitNebula: No CA cert or key found, generating new ones")
-		cmd := exec.Command(nebulaCertPath, "ca", "--name", "ZeroShare, Inc")
-		// Capture the output
-		output, err := cmd.CombinedOutput()
+		caCrt, caKey, err := generateCA("ZeroShare, Inc", caDuration)
 		if err != nil {
-			// Handle the error
 			log.Panic(err)
 		}
-		// Print the output
-		log.Printf("%s", string(output))
+		if err := os.MkdirAll(filepath.Dir(caCrtPath), 0755); err != nil {
+			log.Panic(err)
+		}
+		if err := caKeyStore.Store(cert.Curve_CURVE25519, caKey); err != nil {
+			log.Panicf("InitNebula: failed to store CA key, provide %s for this key backend: %v", caCrtPath, err)
+		}
+		if err := os.WriteFile(caCrtPath, caCrt, 0600); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	// Load the key up front so a wrong passphrase or missing secret fails at startup
+	if _, err := caKeyStore.Signer(); err != nil {
+		log.Panic(err)
+	}
+
+	if err := registerActiveCA(db); err != nil {
+		log.Panic(err)
+	}
+
+	if err := issueLighthouseCert(); err != nil {
+		log.Panic(err)
 	}
 }
 
-func SignPublicKey(publicKey string, deviceId string, db *gorm.DB) (string, string, map[string]interface{}, error) {
-	uid := uuid.New().String()
-	fileName := fmt.Sprintf("%s.pub", uid)
-	// Save the public key to the file
-	if err := os.WriteFile(fileName, []byte(publicKey), 0644); err != nil {
-		return "", "", map[string]interface{}{}, err
+// SignPublicKey signs a key for one of the user's devices, which SignDeviceCertificate only does
+// once the device is approved
+func SignPublicKey(publicKey string, deviceId string, userId interface{}, db *gorm.DB) (structs.SignedCertResponse, error) {
+	var device structs.Device
+	err := db.Where("device_id = ? AND user_id = ?", deviceId, userId).First(&device).Error
+	if err != nil {
+		return structs.SignedCertResponse{}, err
 	}
-	defer os.Remove(fileName)
 
-	var latestDevice structs.Device
-	var lastIp string = ""
-	err := db.Model(&structs.Device{}).Where("ip_address IS NOT NULL AND ip_address <> ''").Order("updated DESC").First(&latestDevice).Error
+	return SignDeviceCertificate(publicKey, device, db)
+}
+
+// SignDeviceCertificate issues a short-lived host cert for the device, keeping its overlay address
+// across renewals.
+func SignDeviceCertificate(publicKey string, device structs.Device, db *gorm.DB) (structs.SignedCertResponse, error) {
+	if device.Status != DeviceStatusApproved {
+		return structs.SignedCertResponse{}, ErrDeviceNotApproved
+	}
 
+	uid := uuid.New().String()
+
+	ip, err := AllocateIP(db, device.ID)
 	if err != nil {
-		// Handle error, e.g., log the error or return an appropriate error response
-		if err != gorm.ErrRecordNotFound {
-			return "", "", map[string]interface{}{}, err
-		}
+		return structs.SignedCertResponse{}, err
 	}
+	log.Printf("Device %s has IP: %s", device.ID, ip)
 
-	lastIp = latestDevice.IpAddress
+	ipNet := &net.IPNet{IP: ip, Mask: networkConfig.Network().Mask}
 
-	var device structs.Device
-	err = db.Where("device_id = ?", deviceId).First(&device).Error
+	certName := fmt.Sprintf("%s.%s", uid, networkConfig.CertDomain)
+
+	caCert, err := os.ReadFile(caCrtPath)
 	if err != nil {
-		return "", "", map[string]interface{}{}, err
+		return structs.SignedCertResponse{}, fmt.Errorf("failed to read CA cert: %v", err)
 	}
 
-	newIP := ""
-	if device.IpAddress == "" {
-		newIP = incrementIP(lastIp)
-	} else {
-		newIP = device.IpAddress
+	caSigner, err := caKeyStore.Signer()
+	if err != nil {
+		return structs.SignedCertResponse{}, fmt.Errorf("failed to load CA key: %v", err)
 	}
-	log.Printf("New IP: %s", newIP)
 
-	ipWithCIDR := fmt.Sprintf("%s/8", newIP)
+	groups, err := deviceGroups(db, device)
+	if err != nil {
+		return structs.SignedCertResponse{}, err
+	}
 
-	db.Where("device_id = ?", deviceId).Updates(structs.Device{IpAddress: newIP})
+	firewall, err := deviceFirewall(db, device, groups)
+	if err != nil {
+		return structs.SignedCertResponse{}, err
+	}
 
-	certName := fmt.Sprintf("%s.neb.jkbx.live", uid)
-	cmd := exec.Command(nebulaCertPath, "sign", "-in-pub", fileName, "-name", certName, "-ip", ipWithCIDR, "-ca-crt", "./certs/ca.crt", "-ca-key", "./certs/ca.key")
-	output, err := cmd.CombinedOutput()
+	hostCert, err := signHostCert(caCert, caSigner, []byte(publicKey), certName, ipNet, groups, networkConfig.certDuration)
 	if err != nil {
-		log.Printf("Nebula cert error: %v, output: %s", err, string(output))
-		return "", "", map[string]interface{}{}, fmt.Errorf("failed to sign certificate: %v", err)
+		log.Printf("Nebula cert error: %v", err)
+		return structs.SignedCertResponse{}, fmt.Errorf("failed to sign certificate: %v", err)
 	}
 
-	// Read the generated certificate file
-	certFile := fmt.Sprintf("%s.crt", certName)
-	certContent, err := os.ReadFile(certFile)
+	certContent, err := hostCert.MarshalToPEM()
 	if err != nil {
-		return "", "", map[string]interface{}{}, fmt.Errorf("failed to read cert file: %v", err)
+		return structs.SignedCertResponse{}, fmt.Errorf("failed to marshal certificate: %v", err)
 	}
-	defer os.Remove(certFile)
 
-	caCert, err := os.ReadFile("./certs/ca.crt")
+	// Keep track of issued certs so they can be revoked by fingerprint later
+	fingerprint, err := hostCert.Sha256Sum()
+	if err != nil {
+		return structs.SignedCertResponse{}, err
+	}
+	err = db.Create(&structs.HostCertificate{
+		Fingerprint:   fingerprint,
+		Name:          certName,
+		IpAddress:     ip.String(),
+		NotBefore:     hostCert.Details.NotBefore.Unix(),
+		NotAfter:      hostCert.Details.NotAfter.Unix(),
+		CaFingerprint: hostCert.Details.Issuer,
+		DeviceId:      device.ID,
+	}).Error
 	if err != nil {
-		return "", "", map[string]interface{}{}, fmt.Errorf("failed to read CA cert: %v", err)
+		return structs.SignedCertResponse{}, err
 	}
 
-	return string(certContent), string(caCert), getIncomingSite(uid), nil
+	return structs.SignedCertResponse{
+		SignedKey:    string(certContent),
+		CaCert:       string(caCert),
+		IncomingSite: getIncomingSite(uid, firewall),
+		NotAfter:     hostCert.Details.NotAfter.Unix(),
+	}, nil
 }
 
-func getIncomingSite(id string) map[string]interface{} {
+func getIncomingSite(id string, firewall map[string]interface{}) map[string]interface{} {
 	return map[string]interface{}{
-		"name": id,
-		"id":   id,
-		"staticHostmap": map[string]interface{}{
-			"42.0.0.1": map[string]interface{}{
-				"lighthouse": true,
-				"destinations": []string{
-					"lighthouse.jkbx.live:4242",
-				},
-			},
-		},
-		"unsafeRoutes": []string{},
-		"ca":           "",
-		"cert":         "",
-		"key":          "",
-		"lhDuration":   0,
-		"port":         0,
-		"mtu":          1300,
-		"cipher":       "aes",
-		"sortKey":      0,
-		"logVerbosity": "info",
-		"managed":      false,
-		"rawConfig":    nil,
+		"name":          id,
+		"id":            id,
+		"staticHostmap": networkConfig.staticHostmap(),
+		"unsafeRoutes":  []string{},
+		"ca":            "",
+		"cert":          "",
+		"key":           "",
+		"lhDuration":    0,
+		"port":          0,
+		"mtu":           1300,
+		"cipher":        "aes",
+		"sortKey":       0,
+		"logVerbosity":  "info",
+		"managed":       false,
+		"rawConfig":     nil,
+		"firewall":      firewall,
 	}
 }
 
@@ -144,19 +180,3 @@ func fileExists(filename string) bool {
 	}
 	return !info.IsDir()
 }
-
-// Increment the given IP address
-func incrementIP(lastIP string) string {
-	ip := net.ParseIP(lastIP).To4()
-	if ip == nil {
-		return "42.0.0.2" // Default if lastIP is nil
-	}
-
-	// Convert IP to a big.Int, increment it, and convert it back
-	ipInt := big.NewInt(0).SetBytes(ip)
-	ipInt.Add(ipInt, big.NewInt(1))
-
-	// Convert back to net.IP
-	newIP := net.IP(ipInt.Bytes())
-	return newIP.String()
-}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"google.golang.org/protobuf/proto"
+)
+
+// Same default lifetime `nebula-cert ca` uses
+const caDuration = time.Hour * 8760
+
+// generateCA creates a new Ed25519 Nebula CA the same way `nebula-cert ca -name <name>` does
+// and returns the PEM encoded certificate and the raw private key for the CA key store.
+func generateCA(name string, duration time.Duration) ([]byte, ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while generating ed25519 keys: %v", err)
+	}
+
+	nc := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			Groups:    []string{},
+			Ips:       []*net.IPNet{},
+			Subnets:   []*net.IPNet{},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(duration),
+			PublicKey: pub,
+			IsCA:      true,
+			Curve:     cert.Curve_CURVE25519,
+		},
+	}
+
+	if err := nc.Sign(cert.Curve_CURVE25519, priv); err != nil {
+		return nil, nil, fmt.Errorf("error while signing: %v", err)
+	}
+
+	crt, err := nc.MarshalToPEM()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while marshalling certificate: %v", err)
+	}
+
+	return crt, priv, nil
+}
+
+// signHostCert signs a host public key with the given CA, following the same steps as
+// `nebula-cert sign -in-pub`. A zero duration, or one past the CA's expiry, expires the cert
+// one second before the CA.
+func signHostCert(caCrtPEM []byte, caSigner crypto.Signer, publicKeyPEM []byte, name string, ipNet *net.IPNet, groups []string, duration time.Duration) (*cert.NebulaCertificate, error) {
+	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(caCrtPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing ca-crt: %v", err)
+	}
+	curve := caCert.Details.Curve
+
+	if !signerMatchesCA(caSigner, caCert) {
+		return nil, fmt.Errorf("refusing to sign, root certificate does not match private key")
+	}
+
+	issuer, err := caCert.Sha256Sum()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting ca-crt fingerprint: %v", err)
+	}
+
+	if caCert.Expired(time.Now()) {
+		return nil, fmt.Errorf("ca certificate is expired")
+	}
+
+	// Never outlive the CA, the cert would be rejected by CheckRootConstrains otherwise
+	if duration <= 0 || time.Now().Add(duration).After(caCert.Details.NotAfter) {
+		duration = time.Until(caCert.Details.NotAfter) - time.Second*1
+	}
+
+	if ipNet == nil || ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid ip definition: can only be ipv4, have %v", ipNet)
+	}
+
+	pub, _, pubCurve, err := cert.UnmarshalPublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing in-pub: %v", err)
+	}
+	if pubCurve != curve {
+		return nil, fmt.Errorf("curve of in-pub does not match ca")
+	}
+
+	nc := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      name,
+			Ips:       []*net.IPNet{ipNet},
+			Groups:    groups,
+			Subnets:   []*net.IPNet{},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(duration),
+			PublicKey: pub,
+			IsCA:      false,
+			Issuer:    issuer,
+			Curve:     curve,
+		},
+	}
+
+	if err := nc.CheckRootConstrains(caCert); err != nil {
+		return nil, fmt.Errorf("refusing to sign, root certificate constraints violated: %v", err)
+	}
+
+	if err := signNebulaCert(&nc, caSigner); err != nil {
+		return nil, fmt.Errorf("error while signing: %v", err)
+	}
+	if !nc.CheckSignature(caCert.Details.PublicKey) {
+		return nil, fmt.Errorf("error while signing: signature does not verify against ca-crt")
+	}
+
+	return &nc, nil
+}
+
+// signNebulaCert does what NebulaCertificate.Sign does, but through a crypto.Signer so the
+// CA key can live in a key store or HSM instead of memory.
+func signNebulaCert(nc *cert.NebulaCertificate, signer crypto.Signer) error {
+	// The signed bytes are the marshalled details, which the cert package only exposes through Marshal
+	b, err := nc.Marshal()
+	if err != nil {
+		return err
+	}
+	var raw cert.RawNebulaCertificate
+	if err := proto.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	details, err := proto.Marshal(raw.Details)
+	if err != nil {
+		return err
+	}
+
+	switch nc.Details.Curve {
+	case cert.Curve_CURVE25519:
+		nc.Signature, err = signer.Sign(rand.Reader, details, crypto.Hash(0))
+	case cert.Curve_P256:
+		// ECDSA signers expect the digest and return an ASN.1 signature, like SignASN1
+		hashed := sha256.Sum256(details)
+		nc.Signature, err = signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	default:
+		return fmt.Errorf("invalid curve: %s", nc.Details.Curve)
+	}
+	return err
+}
+
+// signerMatchesCA checks the signer's public key is the one in the CA cert
+func signerMatchesCA(signer crypto.Signer, ca *cert.NebulaCertificate) bool {
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		return ca.Details.Curve == cert.Curve_CURVE25519 && bytes.Equal(pub, ca.Details.PublicKey)
+	case *ecdsa.PublicKey:
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return false
+		}
+		return ca.Details.Curve == cert.Curve_P256 && bytes.Equal(ecdhPub.Bytes(), ca.Details.PublicKey)
+	default:
+		return false
+	}
+}
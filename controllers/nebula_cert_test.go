@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func newHostPublicKey(t *testing.T) []byte {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	return cert.MarshalX25519PublicKey(key.PublicKey().Bytes())
+}
+
+// TestSignHostCert tests that signHostCert produces a cert the CA pool accepts
+func TestSignHostCert(t *testing.T) {
+	caCrt, caKey, err := generateCA("ZeroShare, Inc", caDuration)
+	assert.NoError(t, err)
+
+	ip, ipNet, _ := net.ParseCIDR("42.0.0.2/8")
+	ipNet.IP = ip.To4()
+
+	t.Run("signs with ca lifetime by default", func(t *testing.T) {
+		signed, err := signHostCert(caCrt, caKey, newHostPublicKey(t), "host.neb.test", ipNet, []string{}, 0)
+		assert.NoError(t, err)
+
+		crt, err := signed.MarshalToPEM()
+		assert.NoError(t, err)
+		nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(crt)
+		assert.NoError(t, err)
+		assert.Equal(t, "host.neb.test", nc.Details.Name)
+		assert.Equal(t, "42.0.0.2/8", nc.Details.Ips[0].String())
+		assert.False(t, nc.Details.IsCA)
+
+		pool := cert.NewCAPool()
+		_, err = pool.AddCACertificate(caCrt)
+		assert.NoError(t, err)
+		ok, err := nc.Verify(time.Now(), pool)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ca, err := pool.GetCAForCert(nc)
+		assert.NoError(t, err)
+		assert.True(t, nc.Details.NotAfter.Before(ca.Details.NotAfter))
+		fingerprint, err := ca.Sha256Sum()
+		assert.NoError(t, err)
+		assert.Equal(t, fingerprint, nc.Details.Issuer)
+	})
+
+	t.Run("honours explicit duration and groups", func(t *testing.T) {
+		nc, err := signHostCert(caCrt, caKey, newHostPublicKey(t), "host.neb.test", ipNet, []string{"user:test", "laptops"}, time.Hour)
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), nc.Details.NotAfter, time.Minute)
+		assert.Equal(t, []string{"user:test", "laptops"}, nc.Details.Groups)
+
+		// The groups are covered by the signature, a tampered cert no longer verifies
+		pool := cert.NewCAPool()
+		_, err = pool.AddCACertificate(caCrt)
+		assert.NoError(t, err)
+		ok, err := nc.Verify(time.Now(), pool)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		nc.Details.Groups = append(nc.Details.Groups, "admins")
+		ok, _ = nc.Verify(time.Now(), pool)
+		assert.False(t, ok)
+	})
+
+	t.Run("rejects mismatched ca key", func(t *testing.T) {
+		_, otherKey, err := generateCA("Other", caDuration)
+		assert.NoError(t, err)
+		_, err = signHostCert(caCrt, otherKey, newHostPublicKey(t), "host.neb.test", ipNet, []string{}, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("signs with a p256 ca", func(t *testing.T) {
+		caPriv, err := ecdh.P256().GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		p256CA := cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:      "P256",
+				NotBefore: time.Now(),
+				NotAfter:  time.Now().Add(time.Hour),
+				PublicKey: caPriv.PublicKey().Bytes(),
+				IsCA:      true,
+				Curve:     cert.Curve_P256,
+			},
+		}
+		assert.NoError(t, p256CA.Sign(cert.Curve_P256, caPriv.Bytes()))
+		p256Crt, err := p256CA.MarshalToPEM()
+		assert.NoError(t, err)
+		signer, err := rawKeySigner(cert.Curve_P256, caPriv.Bytes())
+		assert.NoError(t, err)
+
+		hostPriv, err := ecdh.P256().GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		hostPub := cert.MarshalPublicKey(cert.Curve_P256, hostPriv.PublicKey().Bytes())
+
+		nc, err := signHostCert(p256Crt, signer, hostPub, "host.neb.test", ipNet, []string{}, 0)
+		assert.NoError(t, err)
+		assert.True(t, nc.CheckSignature(p256CA.Details.PublicKey))
+	})
+
+	t.Run("rejects invalid public key", func(t *testing.T) {
+		_, err := signHostCert(caCrt, caKey, []byte("not a key"), "host.neb.test", ipNet, []string{}, 0)
+		assert.Error(t, err)
+	})
+}
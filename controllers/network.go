@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+const defaultNetworkConfigPath = "./config/network.yml"
+
+type LighthouseConfig struct {
+	Ip           string   `yaml:"ip" json:"ip"`
+	Destinations []string `yaml:"destinations" json:"destinations"`
+}
+
+type NetworkConfig struct {
+	Cidr        string             `yaml:"cidr" json:"cidr"`
+	CertDomain  string             `yaml:"cert_domain" json:"cert_domain"`
+	Lighthouses []LighthouseConfig `yaml:"lighthouses" json:"lighthouses"`
+	// Extra ranges the allocator must never hand out, either "a.b.c.d" or "a.b.c.d-e.f.g.h"
+	Reserved []string `yaml:"reserved" json:"reserved"`
+	// Lifetime of signed host certs and how long before expiry devices are told to renew
+	CertDuration string `yaml:"cert_duration" json:"cert_duration"`
+	RenewBefore  string `yaml:"renew_before" json:"renew_before"`
+
+	network      *net.IPNet
+	certDuration time.Duration
+	renewBefore  time.Duration
+}
+
+var networkConfig = defaultNetworkConfig()
+
+func defaultNetworkConfig() *NetworkConfig {
+	config := &NetworkConfig{
+		Cidr:       "42.0.0.0/8",
+		CertDomain: "neb.jkbx.live",
+		Lighthouses: []LighthouseConfig{
+			{Ip: "42.0.0.1", Destinations: []string{"lighthouse.jkbx.live:4242"}},
+		},
+		Reserved:     []string{},
+		CertDuration: "168h",
+		RenewBefore:  "48h",
+	}
+	if err := config.validate(); err != nil {
+		log.Panic(err)
+	}
+	return config
+}
+
+// InitNetworkConfig loads the overlay network settings from the YAML file at NEBULA_NETWORK_CONFIG
+// (./config/network.yml by default) and then applies any NEBULA_* env overrides on top.
+func InitNetworkConfig() *NetworkConfig {
+	config, err := loadNetworkConfig(os.Getenv("NEBULA_NETWORK_CONFIG"))
+	if err != nil {
+		log.Fatal("Failed to load network config: ", err)
+	}
+	networkConfig = config
+	log.Printf("Overlay network %s with %d lighthouse(s), cert domain %s", config.Cidr, len(config.Lighthouses), config.CertDomain)
+	return config
+}
+
+func loadNetworkConfig(path string) (*NetworkConfig, error) {
+	config := defaultNetworkConfig()
+
+	if path == "" {
+		path = defaultNetworkConfigPath
+	}
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if err := yaml.Unmarshal(content, config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	if cidr := os.Getenv("NEBULA_CIDR"); cidr != "" {
+		config.Cidr = cidr
+	}
+	if domain := os.Getenv("NEBULA_CERT_DOMAIN"); domain != "" {
+		config.CertDomain = domain
+	}
+	if lighthouses := os.Getenv("NEBULA_LIGHTHOUSES"); lighthouses != "" {
+		config.Lighthouses, err = parseLighthouses(lighthouses)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reserved := os.Getenv("NEBULA_RESERVED_IPS"); reserved != "" {
+		config.Reserved = strings.Split(reserved, ",")
+	}
+	if duration := os.Getenv("NEBULA_CERT_DURATION"); duration != "" {
+		config.CertDuration = duration
+	}
+	if renewBefore := os.Getenv("NEBULA_CERT_RENEW_BEFORE"); renewBefore != "" {
+		config.RenewBefore = renewBefore
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parseLighthouses reads the NEBULA_LIGHTHOUSES format:
+// "42.0.0.1=lh1.example.com:4242,lh1.example.net:4242;42.0.0.2=lh2.example.com:4242"
+func parseLighthouses(value string) ([]LighthouseConfig, error) {
+	lighthouses := []LighthouseConfig{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ip, destinations, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid lighthouse %q, expected ip=host:port[,host:port]", entry)
+		}
+		lighthouse := LighthouseConfig{Ip: strings.TrimSpace(ip), Destinations: []string{}}
+		for _, destination := range strings.Split(destinations, ",") {
+			if destination = strings.TrimSpace(destination); destination != "" {
+				lighthouse.Destinations = append(lighthouse.Destinations, destination)
+			}
+		}
+		lighthouses = append(lighthouses, lighthouse)
+	}
+	return lighthouses, nil
+}
+
+func (n *NetworkConfig) validate() error {
+	_, network, err := net.ParseCIDR(n.Cidr)
+	if err != nil || network.IP.To4() == nil {
+		return fmt.Errorf("invalid overlay cidr %q, must be ipv4", n.Cidr)
+	}
+	ones, _ := network.Mask.Size()
+	if ones > 30 {
+		return fmt.Errorf("overlay cidr %q is too small", n.Cidr)
+	}
+	n.network = network
+
+	n.CertDomain = strings.Trim(n.CertDomain, ".")
+	if n.CertDomain == "" {
+		return fmt.Errorf("cert domain must not be empty")
+	}
+
+	if len(n.Lighthouses) == 0 {
+		return fmt.Errorf("at least one lighthouse must be configured")
+	}
+	for _, lighthouse := range n.Lighthouses {
+		ip := net.ParseIP(lighthouse.Ip).To4()
+		if ip == nil || !network.Contains(ip) {
+			return fmt.Errorf("lighthouse ip %q is not inside %s", lighthouse.Ip, n.Cidr)
+		}
+		if len(lighthouse.Destinations) == 0 {
+			return fmt.Errorf("lighthouse %s has no destinations", lighthouse.Ip)
+		}
+		for _, destination := range lighthouse.Destinations {
+			if _, _, err := net.SplitHostPort(destination); err != nil {
+				return fmt.Errorf("invalid destination %q for lighthouse %s: %v", destination, lighthouse.Ip, err)
+			}
+		}
+	}
+
+	for _, reserved := range n.Reserved {
+		if _, _, err := n.reservedRange(reserved); err != nil {
+			return err
+		}
+	}
+
+	n.certDuration, err = time.ParseDuration(n.CertDuration)
+	if err != nil || n.certDuration <= 0 {
+		return fmt.Errorf("invalid cert duration %q", n.CertDuration)
+	}
+	n.renewBefore, err = time.ParseDuration(n.RenewBefore)
+	if err != nil || n.renewBefore <= 0 || n.renewBefore >= n.certDuration {
+		return fmt.Errorf("invalid renew before %q, must be positive and shorter than the cert duration", n.RenewBefore)
+	}
+	return nil
+}
+
+// reservedRange splits a Reserved entry into its first and last address
+func (n *NetworkConfig) reservedRange(value string) (string, string, error) {
+	start, end, found := strings.Cut(strings.TrimSpace(value), "-")
+	if !found {
+		end = start
+	}
+	start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+	for _, ip := range []string{start, end} {
+		parsed := net.ParseIP(ip).To4()
+		if parsed == nil || !n.network.Contains(parsed) {
+			return "", "", fmt.Errorf("reserved address %q is not inside %s", ip, n.Cidr)
+		}
+	}
+	return start, end, nil
+}
+
+// Network is the parsed overlay CIDR
+func (n *NetworkConfig) Network() *net.IPNet {
+	return n.network
+}
+
+func (n *NetworkConfig) staticHostmap() map[string]interface{} {
+	hostmap := map[string]interface{}{}
+	for _, lighthouse := range n.Lighthouses {
+		hostmap[lighthouse.Ip] = map[string]interface{}{
+			"lighthouse":   true,
+			"destinations": lighthouse.Destinations,
+		}
+	}
+	return hostmap
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadNetworkConfig tests the YAML file and env overrides
+func TestLoadNetworkConfig(t *testing.T) {
+	t.Run("defaults when file is missing", func(t *testing.T) {
+		config, err := loadNetworkConfig(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.NoError(t, err)
+		assert.Equal(t, "42.0.0.0/8", config.Network().String())
+		assert.Equal(t, "neb.jkbx.live", config.CertDomain)
+	})
+
+	t.Run("yaml file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "network.yml")
+		os.WriteFile(path, []byte(`cidr: 10.10.0.0/16
+cert_domain: .mesh.example.com.
+lighthouses:
+  - ip: 10.10.0.1
+    destinations: [lh1.example.com:4242, lh1.example.net:4242]
+  - ip: 10.10.0.2
+    destinations: [lh2.example.com:4242]
+reserved: [10.10.0.3-10.10.0.9]
+`), 0644)
+
+		config, err := loadNetworkConfig(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.10.0.0/16", config.Network().String())
+		assert.Equal(t, "mesh.example.com", config.CertDomain)
+		assert.Len(t, config.staticHostmap(), 2)
+
+		start, end, err := config.reservedRange(config.Reserved[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "10.10.0.3", start)
+		assert.Equal(t, "10.10.0.9", end)
+	})
+
+	t.Run("env overrides", func(t *testing.T) {
+		t.Setenv("NEBULA_CIDR", "100.64.0.0/10")
+		t.Setenv("NEBULA_LIGHTHOUSES", "100.64.0.1=a.example.com:4242,b.example.com:4242;100.64.0.2=c.example.com:4242")
+		config, err := loadNetworkConfig(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.example.com:4242", "b.example.com:4242"}, config.Lighthouses[0].Destinations)
+		assert.Equal(t, "100.64.0.2", config.Lighthouses[1].Ip)
+	})
+
+	t.Run("lighthouse outside cidr", func(t *testing.T) {
+		t.Setenv("NEBULA_CIDR", "10.0.0.0/8")
+		_, err := loadNetworkConfig(filepath.Join(t.TempDir(), "missing.yml"))
+		assert.Error(t, err)
+	})
+}
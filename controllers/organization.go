@@ -0,0 +1,572 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"strings"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Organization roles, each can do everything the ones below it can
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+var orgRoleRanks = map[string]int{OrgRoleMember: 1, OrgRoleAdmin: 2, OrgRoleOwner: 3}
+
+// Invited users are pending members until they accept
+const (
+	OrgMemberStatusPending  = "pending"
+	OrgMemberStatusAccepted = "accepted"
+)
+
+var (
+	ErrMemberNotFound = errors.New("member not found")
+	ErrOutranked      = errors.New("member has a role above the caller's")
+)
+
+// Group every device of an organization's members carries, members' devices are let in from it
+func orgGroup(orgId uuid.UUID) string {
+	return "org:" + orgId.String()
+}
+
+// orgRoleAtLeast reports whether role is min or above
+func orgRoleAtLeast(role string, min string) bool {
+	return orgRoleRanks[role] >= orgRoleRanks[min]
+}
+
+// orgMembership returns the user's accepted membership, with its organization loaded
+func orgMembership(db *gorm.DB, userId interface{}) (structs.OrganizationMember, error) {
+	var member structs.OrganizationMember
+	err := db.Preload("Organization").
+		Where("user_id = ? AND status = ?", userId, OrgMemberStatusAccepted).First(&member).Error
+	return member, err
+}
+
+// hasMembership reports whether the user is in or invited to an organization
+func hasMembership(db *gorm.DB, userId interface{}) (bool, error) {
+	var count int64
+	err := db.Model(&structs.OrganizationMember{}).Where("user_id = ?", userId).Count(&count).Error
+	return count > 0, err
+}
+
+// sameOrganization reports whether the two users are accepted members of the same organization
+func sameOrganization(db *gorm.DB, userId interface{}, otherId interface{}) (bool, error) {
+	var count int64
+	err := db.Table("organization_members AS a").
+		Joins("JOIN organization_members AS b ON a.organization_id = b.organization_id").
+		Where("a.user_id = ? AND b.user_id = ?", userId, otherId).
+		Where("a.status = ? AND b.status = ?", OrgMemberStatusAccepted, OrgMemberStatusAccepted).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// managedUserIds returns the other accepted members of the user's organization if the user is one
+// of its admins
+func managedUserIds(db *gorm.DB, userId interface{}) ([]uuid.UUID, error) {
+	member, err := orgMembership(db, userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !orgRoleAtLeast(member.Role, OrgRoleAdmin)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []uuid.UUID
+	err = db.Model(&structs.OrganizationMember{}).
+		Where("organization_id = ? AND user_id <> ? AND status = ?", member.OrganizationId, member.UserId, OrgMemberStatusAccepted).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// OrgRoleRequired only lets through members of an organization with at least the given role.
+// The membership is left in c.Locals("orgMember").
+func OrgRoleRequired(db *gorm.DB, role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userId, _ := GetFromToken(c, "ID")
+		member, err := orgMembership(db, userId)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Not a member of an organization",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if !orgRoleAtLeast(member.Role, role) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Organization " + role + " access required",
+			})
+		}
+		c.Locals("orgMember", member)
+		return c.Next()
+	}
+}
+
+// notifyOrganizationChange tells a user their organization changed. Like contacts, their devices
+// only pick up the organization's group and firewall on their next cert renewal.
+func notifyOrganizationChange(db *gorm.DB, redisStore *redis.Client, userId uuid.UUID, orgId uuid.UUID) {
+	if err := notifyUser(db, redisStore, userId, "organization_changed", fiber.Map{"id": orgId}); err != nil {
+		log.Println("Failed to notify user of organization change:", err)
+	}
+}
+
+// CreateOrganization creates an organization owned by the caller
+func CreateOrganization(c *fiber.Ctx, db *gorm.DB) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	body := new(structs.OrganizationRequest)
+	if err := c.BodyParser(body); err != nil || strings.TrimSpace(body.Name) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name is required",
+		})
+	}
+
+	if member, err := hasMembership(db, userId); err != nil || member {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Already a member of or invited to an organization",
+		})
+	}
+
+	org := structs.Organization{Name: strings.TrimSpace(body.Name)}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+		return tx.Create(&structs.OrganizationMember{
+			OrganizationId: org.ID,
+			UserId:         userId,
+			Role:           OrgRoleOwner,
+			Status:         OrgMemberStatusAccepted,
+		}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(org)
+}
+
+// GetOrganization shows the caller's organization and its members, pending invites included
+func GetOrganization(c *fiber.Ctx, db *gorm.DB) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+
+	var members []structs.OrganizationMember
+	err := db.Preload("User").Where("organization_id = ?", member.OrganizationId).
+		Order("created ASC").Find(&members).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	response := structs.OrganizationResponse{
+		Organization: member.Organization,
+		Role:         member.Role,
+		Members:      make([]structs.OrganizationMemberResponse, len(members)),
+	}
+	for i, m := range members {
+		response.Members[i] = structs.OrganizationMemberResponse{
+			UserId:  m.UserId,
+			Name:    m.User.Name,
+			Email:   m.User.Email,
+			Picture: m.User.Picture,
+			Role:    m.Role,
+			Status:  m.Status,
+			Created: m.Created,
+		}
+	}
+	return c.JSON(response)
+}
+
+func UpdateOrganization(c *fiber.Ctx, db *gorm.DB) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+
+	body := new(structs.OrganizationRequest)
+	if err := c.BodyParser(body); err != nil || strings.TrimSpace(body.Name) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name is required",
+		})
+	}
+
+	org := member.Organization
+	org.Name = strings.TrimSpace(body.Name)
+	if err := db.Model(&org).Update("name", org.Name).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(org)
+}
+
+// DeleteOrganization removes the organization and all its memberships, the members' devices
+// stay with their users
+func DeleteOrganization(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+
+	var userIds, acceptedIds []uuid.UUID
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&structs.OrganizationMember{}).
+			Where("organization_id = ?", member.OrganizationId).Pluck("user_id", &userIds).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&structs.OrganizationMember{}).
+			Where("organization_id = ? AND status = ?", member.OrganizationId, OrgMemberStatusAccepted).
+			Pluck("user_id", &acceptedIds).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("organization_id = ?", member.OrganizationId).Delete(&structs.OrganizationMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&structs.Organization{}, "id = ?", member.OrganizationId).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	// Every member's cert carries the org group, which every member's firewall still admits
+	if err := RevokeUserCertificates(db, redisStore, acceptedIds, "organization deleted"); err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke certificates",
+		})
+	}
+	for _, userId := range userIds {
+		notifyOrganizationChange(db, redisStore, userId, member.OrganizationId)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// AddOrganizationMember invites the user with the given email, who can't be in or invited to
+// another organization. Nobody can hand out a role above their own.
+func AddOrganizationMember(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+
+	body := new(structs.OrganizationMemberRequest)
+	if err := c.BodyParser(body); err != nil || strings.TrimSpace(body.Email) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email is required",
+		})
+	}
+	if body.Role == "" {
+		body.Role = OrgRoleMember
+	}
+	if _, ok := orgRoleRanks[body.Role]; !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid role",
+		})
+	}
+	if !orgRoleAtLeast(member.Role, body.Role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Cannot grant a role above your own",
+		})
+	}
+
+	var user structs.User
+	if err := db.Where("LOWER(email) = LOWER(?)", strings.TrimSpace(body.Email)).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No user with that email",
+		})
+	}
+	if invited, err := hasMembership(db, user.ID); err != nil || invited {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User is already a member of or invited to an organization",
+		})
+	}
+
+	added := structs.OrganizationMember{
+		OrganizationId: member.OrganizationId,
+		UserId:         user.ID,
+		Role:           body.Role,
+		Status:         OrgMemberStatusPending,
+	}
+	if err := db.Create(&added).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	invite := structs.OrganizationInviteResponse{
+		Organization: member.Organization,
+		Role:         added.Role,
+		Created:      added.Created,
+	}
+	if err := notifyUser(db, redisStore, user.ID, "organization_invite", invite); err != nil {
+		log.Println("Failed to notify user of organization invite:", err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(added)
+}
+
+// pendingInvite loads the invite waiting for the caller, with its organization
+func pendingInvite(db *gorm.DB, userId uuid.UUID) (structs.OrganizationMember, error) {
+	var invite structs.OrganizationMember
+	err := db.Preload("Organization").
+		Where("user_id = ? AND status = ?", userId, OrgMemberStatusPending).First(&invite).Error
+	return invite, err
+}
+
+// GetOrganizationInvite shows the caller the organization they were invited to
+func GetOrganizationInvite(c *fiber.Ctx, db *gorm.DB) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+	invite, err := pendingInvite(db, userId)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pending invite not found",
+		})
+	}
+	return c.JSON(structs.OrganizationInviteResponse{
+		Organization: invite.Organization,
+		Role:         invite.Role,
+		Created:      invite.Created,
+	})
+}
+
+// AcceptOrganizationInvite makes the caller a member of the organization that invited them
+func AcceptOrganizationInvite(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+	invite, err := pendingInvite(db, userId)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pending invite not found",
+		})
+	}
+
+	result := db.Model(&structs.OrganizationMember{}).
+		Where("id = ? AND status = ?", invite.ID, OrgMemberStatusPending).
+		Update("status", OrgMemberStatusAccepted)
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Invite has already been answered",
+		})
+	}
+	invite.Status = OrgMemberStatusAccepted
+
+	notifyOrganizationChange(db, redisStore, userId, invite.OrganizationId)
+	return c.JSON(invite)
+}
+
+// RejectOrganizationInvite turns down the caller's invite, the organization can invite them again
+func RejectOrganizationInvite(c *fiber.Ctx, db *gorm.DB) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+	result := db.Where("user_id = ? AND status = ?", userId, OrgMemberStatusPending).
+		Delete(&structs.OrganizationMember{})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pending invite not found",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// targetMember loads a member of the caller's organization that the caller doesn't outrank
+func targetMember(db *gorm.DB, member structs.OrganizationMember, userId string) (structs.OrganizationMember, error) {
+	var target structs.OrganizationMember
+	err := db.Where("organization_id = ? AND user_id = ?", member.OrganizationId, userId).First(&target).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return target, ErrMemberNotFound
+	}
+	if err != nil {
+		return target, err
+	}
+	if target.UserId != member.UserId && !orgRoleAtLeast(member.Role, target.Role) {
+		return target, ErrOutranked
+	}
+	return target, nil
+}
+
+func targetMemberError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrMemberNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Member not found",
+		})
+	case errors.Is(err, ErrOutranked):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Cannot change a member with a role above your own",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Database error",
+	})
+}
+
+// isLastOwner reports whether the member is their organization's only accepted owner
+func isLastOwner(db *gorm.DB, member structs.OrganizationMember) (bool, error) {
+	if member.Role != OrgRoleOwner || member.Status != OrgMemberStatusAccepted {
+		return false, nil
+	}
+	var owners int64
+	err := db.Model(&structs.OrganizationMember{}).
+		Where("organization_id = ? AND role = ? AND status = ?", member.OrganizationId, OrgRoleOwner, OrgMemberStatusAccepted).
+		Count(&owners).Error
+	return owners <= 1, err
+}
+
+func UpdateOrganizationMember(c *fiber.Ctx, db *gorm.DB) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+	target, err := targetMember(db, member, c.Params("userId"))
+	if err != nil {
+		return targetMemberError(c, err)
+	}
+
+	body := new(structs.OrganizationMemberRequest)
+	c.BodyParser(body)
+	if _, ok := orgRoleRanks[body.Role]; !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid role",
+		})
+	}
+	if !orgRoleAtLeast(member.Role, body.Role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Cannot grant a role above your own",
+		})
+	}
+	if lastOwner, err := isLastOwner(db, target); err != nil || (lastOwner && body.Role != OrgRoleOwner) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An organization needs at least one owner",
+		})
+	}
+
+	if err := db.Model(&target).Update("role", body.Role).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(target)
+}
+
+// RemoveOrganizationMember removes a member. Admins can remove members up to their own role,
+// everyone can leave.
+func RemoveOrganizationMember(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+	if c.Params("userId") != member.UserId.String() && !orgRoleAtLeast(member.Role, OrgRoleAdmin) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Organization admin access required",
+		})
+	}
+	target, err := targetMember(db, member, c.Params("userId"))
+	if err != nil {
+		return targetMemberError(c, err)
+	}
+	if lastOwner, err := isLastOwner(db, target); err != nil || lastOwner {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An organization needs at least one owner",
+		})
+	}
+
+	if err := db.Delete(&target).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	// The member's certs carry the org group until they expire, the other members admit it
+	if target.Status == OrgMemberStatusAccepted {
+		if err := RevokeUserCertificates(db, redisStore, []uuid.UUID{target.UserId}, "removed from organization"); err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to revoke certificates",
+			})
+		}
+	}
+
+	notifyOrganizationChange(db, redisStore, target.UserId, member.OrganizationId)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// orgDevices scopes a query to the devices of the organization's accepted members
+func orgDevices(db *gorm.DB, orgId uuid.UUID) *gorm.DB {
+	members := db.Model(&structs.OrganizationMember{}).Select("user_id").
+		Where("organization_id = ? AND status = ?", orgId, OrgMemberStatusAccepted)
+	return db.Model(&structs.Device{}).Where("user_id IN (?)", members)
+}
+
+// ListOrganizationDevices lets members discover each other's approved devices
+func ListOrganizationDevices(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+
+	var devices []*structs.Device
+	query := orgDevices(db, member.OrganizationId).Where("status = ?", DeviceStatusApproved)
+	if platform := c.Query("platform"); platform != "" {
+		query = query.Where("platform = ?", platform)
+	}
+	if search := c.Query("q"); search != "" {
+		query = query.Where("machine_name ILIKE ?", "%"+escapeLike(search)+"%")
+	}
+	if err := query.Order("machine_name ASC").Find(&devices).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if err := FillPresence(c.Context(), redisStore, devices); err != nil {
+		log.Println("Failed to read presence:", err)
+	}
+	return c.JSON(sharedDevices(devices))
+}
+
+// ListOrganizationDevicesAdmin shows org admins every device of the organization's members,
+// pending ones included. It takes ListDevices' parameters plus user_id.
+func ListOrganizationDevicesAdmin(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+
+	query := orgDevices(db, member.OrganizationId)
+	if userId := c.Query("user_id"); userId != "" {
+		query = query.Where("user_id = ?", userId)
+	}
+	return listDevices(c, redisStore, query)
+}
+
+// DeleteOrganizationDevice lets org admins remove a member's device, revoking its certs
+func DeleteOrganizationDevice(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	member := c.Locals("orgMember").(structs.OrganizationMember)
+
+	var device structs.Device
+	if err := orgDevices(db, member.OrganizationId).Where("id = ?", c.Params("id")).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+	return deleteDevice(c, db, redisStore, device)
+}
@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOrgRoleAtLeast tests the ranking of organization roles
+func TestOrgRoleAtLeast(t *testing.T) {
+	assert.True(t, orgRoleAtLeast(OrgRoleOwner, OrgRoleAdmin))
+	assert.True(t, orgRoleAtLeast(OrgRoleAdmin, OrgRoleAdmin))
+	assert.True(t, orgRoleAtLeast(OrgRoleMember, OrgRoleMember))
+	assert.False(t, orgRoleAtLeast(OrgRoleMember, OrgRoleAdmin))
+	assert.False(t, orgRoleAtLeast(OrgRoleAdmin, OrgRoleOwner))
+	assert.False(t, orgRoleAtLeast("", OrgRoleMember), "unknown roles rank below member")
+}
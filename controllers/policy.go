@@ -0,0 +1,310 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"zeroshare-backend/middlewares"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Target group of firewall rules that apply to every device
+const anyGroup = "any"
+
+// Prefixes of groups the backend derives itself, admins can't hand these out
+var reservedGroupPrefixes = []string{"user:", "org:"}
+
+var portPattern = regexp.MustCompile(`^(any|fragment|\d{1,5}(-\d{1,5})?)$`)
+
+// Group every device of a user carries, the user's other devices are always let in from it
+func userGroup(userId uuid.UUID) string {
+	return "user:" + userId.String()
+}
+
+// IsAdmin reports whether the caller's token carries the admin role
+func IsAdmin(c *fiber.Ctx) bool {
+	return middlewares.HasRole(c, middlewares.RoleAdmin)
+}
+
+// userRole is the role signed into the user's tokens. Verified emails listed in ADMIN_EMAILS are
+// always admins, so there is someone to hand out the role in the first place.
+func userRole(user structs.User) string {
+	if user.Role == middlewares.RoleAdmin || envAdmin(user) {
+		return middlewares.RoleAdmin
+	}
+	return middlewares.RoleUser
+}
+
+// envAdmin reports whether the user's verified email is listed in ADMIN_EMAILS
+func envAdmin(user structs.User) bool {
+	if !user.VerifiedEmail || user.Email == "" {
+		return false
+	}
+	for _, admin := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if strings.EqualFold(strings.TrimSpace(admin), user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceGroups returns the groups to sign into the device's cert. Since certs are immutable,
+// assignment changes only reach a device once it renews its cert.
+func deviceGroups(db *gorm.DB, device structs.Device) ([]string, error) {
+	assigned := []string{}
+	err := db.Model(&structs.GroupAssignment{}).
+		Where("user_id = ? OR device_id = ?", device.UserId, device.ID).
+		Pluck("group_name", &assigned).Error
+	if err != nil {
+		return nil, err
+	}
+
+	groups := append([]string{userGroup(device.UserId)}, assigned...)
+	member, err := orgMembership(db, device.UserId)
+	if err == nil {
+		groups = append(groups, orgGroup(member.OrganizationId))
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	return uniqueGroups(groups), nil
+}
+
+func uniqueGroups(groups []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, group := range groups {
+		if !seen[group] {
+			seen[group] = true
+			unique = append(unique, group)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// deviceFirewall builds the Nebula firewall section for a device carrying the given groups.
+// Anything not matched by a rule is dropped, so other users' devices can't get in unless
+// they belong to an accepted contact or the device's organization.
+func deviceFirewall(db *gorm.DB, device structs.Device, groups []string) (map[string]interface{}, error) {
+	inbound := []map[string]interface{}{
+		{"port": "any", "proto": "any", "group": userGroup(device.UserId)},
+	}
+	for _, group := range groups {
+		if strings.HasPrefix(group, "org:") {
+			inbound = append(inbound, map[string]interface{}{"port": "any", "proto": "any", "group": group})
+		}
+	}
+
+	contacts, err := contactUserIds(db, device.UserId)
+	if err != nil {
+		return nil, err
+	}
+	for _, contact := range contacts {
+		inbound = append(inbound, map[string]interface{}{"port": "any", "proto": "any", "group": userGroup(contact)})
+	}
+
+	var rules []structs.FirewallRule
+	if err := db.Where("target_group IN ?", append(groups, anyGroup)).Order("created").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		inbound = append(inbound, firewallEntry(rule))
+	}
+
+	return map[string]interface{}{
+		"outbound": []map[string]interface{}{
+			{"port": "any", "proto": "any", "host": "any"},
+		},
+		"inbound": inbound,
+	}, nil
+}
+
+func firewallEntry(rule structs.FirewallRule) map[string]interface{} {
+	entry := map[string]interface{}{
+		"port":  rule.Port,
+		"proto": rule.Proto,
+	}
+	if rule.Group != "" {
+		entry["group"] = rule.Group
+	}
+	if rule.Host != "" {
+		entry["host"] = rule.Host
+	}
+	if rule.Cidr != "" {
+		entry["cidr"] = rule.Cidr
+	}
+	return entry
+}
+
+func validateGroupName(group string) error {
+	if group == "" || group == anyGroup || strings.ContainsAny(group, ", \t\n") {
+		return fmt.Errorf("invalid group name %q", group)
+	}
+	for _, prefix := range reservedGroupPrefixes {
+		if strings.HasPrefix(group, prefix) {
+			return fmt.Errorf("group prefix %q is reserved", prefix)
+		}
+	}
+	return nil
+}
+
+func validateFirewallRule(rule *structs.FirewallRule) error {
+	if rule.TargetGroup != anyGroup && !strings.HasPrefix(rule.TargetGroup, "user:") {
+		if err := validateGroupName(rule.TargetGroup); err != nil {
+			return err
+		}
+	}
+	if rule.Port == "" {
+		rule.Port = "any"
+	}
+	if !portPattern.MatchString(rule.Port) {
+		return fmt.Errorf("invalid port %q", rule.Port)
+	}
+	if rule.Proto == "" {
+		rule.Proto = "any"
+	}
+	switch rule.Proto {
+	case "any", "tcp", "udp", "icmp":
+	default:
+		return fmt.Errorf("invalid proto %q", rule.Proto)
+	}
+	if rule.Group == "" && rule.Host == "" && rule.Cidr == "" {
+		return fmt.Errorf("one of group, host or cidr is required")
+	}
+	if rule.Cidr != "" {
+		if _, _, err := net.ParseCIDR(rule.Cidr); err != nil {
+			return fmt.Errorf("invalid cidr %q", rule.Cidr)
+		}
+	}
+	return nil
+}
+
+func ListGroupAssignments(c *fiber.Ctx, db *gorm.DB) error {
+	assignments := []structs.GroupAssignment{}
+	query := db.Order("created")
+	if group := c.Query("group"); group != "" {
+		query = query.Where("group_name = ?", group)
+	}
+	if err := query.Find(&assignments).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(assignments)
+}
+
+func CreateGroupAssignment(c *fiber.Ctx, db *gorm.DB) error {
+	assignment := new(structs.GroupAssignment)
+	if err := c.BodyParser(assignment); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if err := validateGroupName(assignment.Group); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if (assignment.UserId == nil) == (assignment.DeviceId == nil) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Exactly one of user_id or device_id is required",
+		})
+	}
+
+	assignment.ID = uuid.Nil
+	if err := db.Create(assignment).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(assignment)
+}
+
+func DeleteGroupAssignment(c *fiber.Ctx, db *gorm.DB) error {
+	result := db.Where("id = ?", c.Params("id")).Delete(&structs.GroupAssignment{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Group assignment not found",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func ListFirewallRules(c *fiber.Ctx, db *gorm.DB) error {
+	rules := []structs.FirewallRule{}
+	if err := db.Order("created").Find(&rules).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(rules)
+}
+
+func CreateFirewallRule(c *fiber.Ctx, db *gorm.DB) error {
+	rule := new(structs.FirewallRule)
+	if err := c.BodyParser(rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if err := validateFirewallRule(rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	rule.ID = uuid.Nil
+	if err := db.Create(rule).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(rule)
+}
+
+func DeleteFirewallRule(c *fiber.Ctx, db *gorm.DB) error {
+	result := db.Where("id = ?", c.Params("id")).Delete(&structs.FirewallRule{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Firewall rule not found",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DeviceFirewall shows the groups and firewall the caller's device gets on its next cert
+func DeviceFirewall(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	var device structs.Device
+	if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	groups, err := deviceGroups(db, device)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	firewall, err := deviceFirewall(db, device, groups)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"groups":   groups,
+		"firewall": firewall,
+	})
+}
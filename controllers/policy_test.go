@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"testing"
+	"zeroshare-backend/middlewares"
+	structs "zeroshare-backend/structs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestValidateFirewallRule tests the checks on admin supplied firewall rules
+func TestValidateFirewallRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  structs.FirewallRule
+		valid bool
+	}{
+		{"group rule with defaults", structs.FirewallRule{TargetGroup: "servers", Group: "laptops"}, true},
+		{"port range and cidr", structs.FirewallRule{TargetGroup: anyGroup, Port: "8000-8080", Proto: "tcp", Cidr: "42.0.0.0/24"}, true},
+		{"rule for one user", structs.FirewallRule{TargetGroup: "user:8c5d1b1e-4b7f-4d39-9d45-0f4c9a3a1f00", Group: "support"}, true},
+		{"missing peer", structs.FirewallRule{TargetGroup: "servers"}, false},
+		{"bad proto", structs.FirewallRule{TargetGroup: "servers", Group: "laptops", Proto: "sctp"}, false},
+		{"bad port", structs.FirewallRule{TargetGroup: "servers", Group: "laptops", Port: "http"}, false},
+		{"bad target group", structs.FirewallRule{TargetGroup: "two words", Group: "laptops"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFirewallRule(&tt.rule)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+// TestValidateGroupName tests that derived group prefixes can't be handed out
+func TestValidateGroupName(t *testing.T) {
+	assert.NoError(t, validateGroupName("laptops"))
+	assert.Error(t, validateGroupName("user:someone"))
+	assert.Error(t, validateGroupName(anyGroup))
+	assert.Error(t, validateGroupName("a,b"))
+}
+
+// TestUserRole tests that ADMIN_EMAILS only grants admin to verified emails
+func TestUserRole(t *testing.T) {
+	t.Setenv("ADMIN_EMAILS", "root@example.com, ops@example.com")
+
+	assert.Equal(t, middlewares.RoleAdmin, userRole(structs.User{Email: "Ops@example.com", VerifiedEmail: true}))
+	assert.Equal(t, middlewares.RoleUser, userRole(structs.User{Email: "ops@example.com"}), "unverified email")
+	assert.Equal(t, middlewares.RoleUser, userRole(structs.User{Email: "someone@example.com", VerifiedEmail: true}))
+	assert.Equal(t, middlewares.RoleAdmin, userRole(structs.User{Email: "someone@example.com", Role: middlewares.RoleAdmin}))
+
+	// Listed admins can't be demoted through the role column
+	assert.True(t, envAdmin(structs.User{Email: "root@example.com", VerifiedEmail: true, Role: middlewares.RoleUser}))
+	assert.False(t, envAdmin(structs.User{Email: "someone@example.com", VerifiedEmail: true, Role: middlewares.RoleAdmin}))
+}
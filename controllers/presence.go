@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	// Connections refresh presence on every ping, a device that misses three in a row is offline
+	PresenceHeartbeatInterval = 15 * time.Second
+	presenceTTL               = 3 * PresenceHeartbeatInterval
+
+	// Hash of device ID to the unix time it was last seen, kept after the device goes offline
+	lastSeenKey = "presence:last_seen"
+)
+
+func presenceKey(deviceId uuid.UUID) string {
+	return "presence:online:" + deviceId.String()
+}
+
+// Number of open connections of a device, across every backend instance. It expires with the
+// presence key, so connections lost in a crash don't keep a device online.
+func connectionsKey(deviceId uuid.UUID) string {
+	return "presence:connections:" + deviceId.String()
+}
+
+// MarkConnected counts a new connection of the device and marks it online. Every call has to be
+// followed by a MarkOffline once the connection closes.
+func MarkConnected(ctx context.Context, db *gorm.DB, redisStore *redis.Client, device structs.Device) error {
+	_, err := redisStore.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, connectionsKey(device.ID))
+		pipe.Expire(ctx, connectionsKey(device.ID), presenceTTL)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return MarkOnline(ctx, db, redisStore, device)
+}
+
+// MarkOnline records a heartbeat from a connected device. It's called through MarkConnected when a
+// device connects and on every ping after that, the user's other devices are told when the device
+// comes online.
+func MarkOnline(ctx context.Context, db *gorm.DB, redisStore *redis.Client, device structs.Device) error {
+	now := time.Now().Unix()
+	err := redisStore.SetArgs(ctx, presenceKey(device.ID), now, redis.SetArgs{TTL: presenceTTL, Get: true}).Err()
+	wasOffline := errors.Is(err, redis.Nil)
+	if err != nil && !wasOffline {
+		return err
+	}
+	if err := redisStore.Expire(ctx, connectionsKey(device.ID), presenceTTL).Err(); err != nil {
+		return err
+	}
+	if err := redisStore.HSet(ctx, lastSeenKey, device.ID.String(), now).Err(); err != nil {
+		return err
+	}
+
+	if wasOffline {
+		device.Online, device.LastSeen = true, now
+		return publishPresence(db, redisStore, device, "device_online")
+	}
+	return nil
+}
+
+// MarkOffline is called when a device's connection closes, the device only goes offline with its
+// last connection. Devices that drop without closing their connection just expire after
+// presenceTTL, without an offline event.
+func MarkOffline(ctx context.Context, db *gorm.DB, redisStore *redis.Client, device structs.Device) error {
+	now := time.Now().Unix()
+	if err := redisStore.HSet(ctx, lastSeenKey, device.ID.String(), now).Err(); err != nil {
+		return err
+	}
+	remaining, err := redisStore.Decr(ctx, connectionsKey(device.ID)).Result()
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	if err := redisStore.Del(ctx, presenceKey(device.ID), connectionsKey(device.ID)).Err(); err != nil {
+		return err
+	}
+
+	device.Online, device.LastSeen = false, now
+	return publishPresence(db, redisStore, device, "device_offline")
+}
+
+// publishPresence tells the user's other devices about a presence change. These aren't queued,
+// a device that is offline gets the current state from the device list instead.
+func publishPresence(db *gorm.DB, redisStore *redis.Client, device structs.Device, eventType string) error {
+	var others []structs.Device
+	if err := db.Where("user_id = ? AND id <> ?", device.UserId, device.ID).Find(&others).Error; err != nil {
+		return err
+	}
+
+	response, err := deviceEvent(eventType, device)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		if err := redisStore.Publish(context.Background(), other.ID.String(), payload).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FillPresence sets Online and LastSeen on devices loaded from the database
+func FillPresence(ctx context.Context, redisStore *redis.Client, devices []*structs.Device) error {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(devices))
+	fields := make([]string, len(devices))
+	for i, device := range devices {
+		keys[i] = presenceKey(device.ID)
+		fields[i] = device.ID.String()
+	}
+
+	online, err := redisStore.MGet(ctx, keys...).Result()
+	if err != nil {
+		return err
+	}
+	lastSeen, err := redisStore.HMGet(ctx, lastSeenKey, fields...).Result()
+	if err != nil {
+		return err
+	}
+
+	for i, device := range devices {
+		device.Online = online[i] != nil
+		if seen, ok := lastSeen[i].(string); ok {
+			device.LastSeen, _ = strconv.ParseInt(seen, 10, 64)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// How long a QR code can be scanned and approved
+const qrLoginTTL = 2 * time.Minute
+
+// Login session tokens are issued by CreateLoginSession, anything shorter can't be one
+const minSessionTokenLength = 16
+
+func qrLoginKey(sessionToken string) string {
+	return "qr-login:" + sessionToken
+}
+
+// StartQRLogin registers the login session a desktop shows as a QR code. The desktop then waits on
+// /sse/:sessionToken until a signed in phone approves it, the QR code alone can't collect the tokens.
+func StartQRLogin(c *fiber.Ctx, redisStore *redis.Client) error {
+	sessionToken := c.Params("token")
+	if len(sessionToken) < minSessionTokenLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Session token is too short",
+		})
+	}
+	body := new(structs.QRLoginRequest)
+	c.BodyParser(body)
+
+	ctx := c.Context()
+	if !loginSessionExists(ctx, redisStore, sessionToken) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown or expired login session",
+		})
+	}
+	now := time.Now()
+	key := qrLoginKey(sessionToken)
+	created, err := redisStore.HSetNX(ctx, key, "created", now.Unix()).Result()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start QR login",
+		})
+	}
+	if !created {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Session token is already in use",
+		})
+	}
+	_, err = redisStore.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"name", body.Name,
+			"platform", body.Platform,
+			"user_agent", c.Get(fiber.HeaderUserAgent),
+			"ip_address", c.IP(),
+			"expires_at", now.Add(qrLoginTTL).Unix(),
+		)
+		pipe.Expire(ctx, key, qrLoginTTL)
+		return nil
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start QR login",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"session_token": sessionToken,
+		"expires_in":    int(qrLoginTTL.Seconds()),
+	})
+}
+
+// pendingQRLogin loads the details of a QR login that hasn't expired or been answered
+func pendingQRLogin(ctx context.Context, redisStore *redis.Client, sessionToken string) (structs.QRLoginInfo, bool) {
+	pending, err := redisStore.HGetAll(ctx, qrLoginKey(sessionToken)).Result()
+	if err != nil || pending["expires_at"] == "" {
+		return structs.QRLoginInfo{}, false
+	}
+	created, _ := strconv.ParseInt(pending["created"], 10, 64)
+	expiresAt, _ := strconv.ParseInt(pending["expires_at"], 10, 64)
+	return structs.QRLoginInfo{
+		Name:      pending["name"],
+		Platform:  pending["platform"],
+		UserAgent: pending["user_agent"],
+		IpAddress: pending["ip_address"],
+		Created:   created,
+		ExpiresAt: expiresAt,
+	}, true
+}
+
+// claimQRLogin deletes the pending login so it can only be answered once
+func claimQRLogin(ctx context.Context, redisStore *redis.Client, sessionToken string) (structs.QRLoginInfo, bool) {
+	info, ok := pendingQRLogin(ctx, redisStore, sessionToken)
+	if !ok {
+		return info, false
+	}
+	deleted, err := redisStore.Del(ctx, qrLoginKey(sessionToken)).Result()
+	return info, err == nil && deleted > 0
+}
+
+func qrLoginNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "QR code has expired or was already used",
+	})
+}
+
+// GetQRLogin shows the scanning phone which desktop it is about to sign in
+func GetQRLogin(c *fiber.Ctx, redisStore *redis.Client) error {
+	info, ok := pendingQRLogin(c.Context(), redisStore, c.Params("token"))
+	if !ok {
+		return qrLoginNotFound(c)
+	}
+	return c.JSON(info)
+}
+
+// ApproveQRLogin signs the desktop in as the caller. The session is recorded with the desktop's
+// details rather than the phone's.
+func ApproveQRLogin(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, err := tokenUserId(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in token",
+		})
+	}
+	sessionToken := c.Params("token")
+	info, ok := claimQRLogin(c.Context(), redisStore, sessionToken)
+	if !ok {
+		return qrLoginNotFound(c)
+	}
+
+	var user structs.User
+	if err := db.Where("id = ?", userId).First(&user).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err := completeLoginSession(c.Context(), redisStore, sessionToken); err != nil {
+		status, message := identityError(err)
+		return c.Status(status).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+	tokenResponse, err := createSession(db, user, info.UserAgent, info.IpAddress)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start session",
+		})
+	}
+	if err := publishTokens(redisStore, sessionToken, tokenResponse); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send tokens",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DenyQRLogin tells the waiting desktop the login was turned down. Like approving, it takes a
+// signed in caller, so nobody else can cancel a login they merely saw the QR code of.
+func DenyQRLogin(c *fiber.Ctx, redisStore *redis.Client) error {
+	if _, err := tokenUserId(c); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in token",
+		})
+	}
+	sessionToken := c.Params("token")
+	if _, ok := claimQRLogin(c.Context(), redisStore, sessionToken); !ok {
+		return qrLoginNotFound(c)
+	}
+	jsonData, _ := json.Marshal(fiber.Map{
+		"error": "Login was denied",
+	})
+	redisStore.Publish(c.Context(), sessionToken, jsonData)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	jtoken "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStartQRLoginShortToken tests that guessable session tokens are refused before touching Redis
+func TestStartQRLoginShortToken(t *testing.T) {
+	app := fiber.New()
+	app.Post("/login/qr/:token", func(c *fiber.Ctx) error {
+		return StartQRLogin(c, nil)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/login/qr/short", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+// TestDenyQRLoginUnauthenticated tests that only a signed in caller can deny a QR login
+func TestDenyQRLoginUnauthenticated(t *testing.T) {
+	app := fiber.New()
+	app.Post("/qr-login/:token/deny", func(c *fiber.Ctx) error {
+		return DenyQRLogin(c, nil)
+	})
+
+	// A token without a user, the auth middleware isn't part of this app
+	token, err := jtoken.NewWithClaims(jtoken.SigningMethodHS256, jtoken.MapClaims{}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	req := httptest.NewRequest("POST", "/qr-login/0123456789abcdef/deny", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
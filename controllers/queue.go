@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const defaultMessageTTL = 72 * time.Hour
+
+// How long queued messages wait for an offline device, set with MESSAGE_TTL
+var messageTTL = defaultMessageTTL
+
+// InitMessageQueue reads the queue settings from the environment
+func InitMessageQueue() {
+	if ttl := os.Getenv("MESSAGE_TTL"); ttl != "" {
+		parsed, err := time.ParseDuration(ttl)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid MESSAGE_TTL %q", ttl)
+		}
+		messageTTL = parsed
+	}
+	log.Printf("Queued messages expire after %s", messageTTL)
+}
+
+// Every device has a Redis stream holding the messages addressed to it, so a device that is
+// offline when a message is sent gets it when it reconnects.
+func queueKey(deviceId string) string {
+	return "queue:" + deviceId
+}
+
+// ID of the newest message the device has acked every message up to, replays start after it
+func queueCursorKey(deviceId string) string {
+	return "queue:cursor:" + deviceId
+}
+
+// DeliverToDevice queues a backend event for the device and publishes it to the device's channel
+// for live delivery. The message's ID and Timestamp are set from its queue entry.
+func DeliverToDevice(ctx context.Context, redisStore *redis.Client, deviceId string, response *structs.SSEResponse) error {
+	return enqueue(ctx, redisStore, deviceId, "", response)
+}
+
+// RelayMessage delivers a message one device sent to another, the sender gets receipts for it
+// once the target acks it.
+func RelayMessage(ctx context.Context, redisStore *redis.Client, senderId string, deviceId string, response *structs.SSEResponse) error {
+	return enqueue(ctx, redisStore, deviceId, senderId, response)
+}
+
+func enqueue(ctx context.Context, redisStore *redis.Client, deviceId string, senderId string, response *structs.SSEResponse) error {
+	response.ID, response.Timestamp = "", 0
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	// Stream IDs start with the unix millis, so anything older than the TTL is trimmed on every add
+	id, err := redisStore.XAdd(ctx, &redis.XAddArgs{
+		Stream: queueKey(deviceId),
+		MinID:  strconv.FormatInt(time.Now().Add(-messageTTL).UnixMilli(), 10),
+		Approx: true,
+		Values: map[string]interface{}{"payload": payload, "type": response.Type, "sender": senderId},
+	}).Result()
+	if err != nil {
+		return err
+	}
+	// Queues of devices that stop receiving messages disappear on their own
+	if err := redisStore.Expire(ctx, queueKey(deviceId), messageTTL).Err(); err != nil {
+		return err
+	}
+	if _, err := setMessageStatus(ctx, redisStore, deviceId, id, MessageStatusQueued); err != nil {
+		return err
+	}
+
+	response.ID, response.Timestamp = id, queueIDMillis(id)
+	payload, err = json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return redisStore.Publish(ctx, deviceId, payload).Err()
+}
+
+// QueuedMessages returns the unexpired messages queued for the device after lastId that it hasn't
+// acked yet. Without a lastId it picks up after the device's acked cursor.
+func QueuedMessages(ctx context.Context, redisStore *redis.Client, deviceId string, lastId string) ([]structs.SSEResponse, error) {
+	if lastId == "" {
+		cursor, err := redisStore.Get(ctx, queueCursorKey(deviceId)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		lastId = cursor
+	}
+
+	start := "-"
+	if lastId != "" {
+		start = "(" + lastId
+	}
+	entries, err := redisStore.XRange(ctx, queueKey(deviceId), start, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := messageStatuses(ctx, redisStore, deviceId, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	oldest := time.Now().Add(-messageTTL).UnixMilli()
+	messages := []structs.SSEResponse{}
+	for _, entry := range entries {
+		// Trimming is approximate, skip anything that has expired but is still in the stream
+		if queueIDMillis(entry.ID) < oldest {
+			continue
+		}
+		// Acked out of order, after the cursor
+		if status := statuses[entry.ID]; status == MessageStatusDelivered || status == MessageStatusRead {
+			continue
+		}
+		payload, _ := entry.Values["payload"].(string)
+		var message structs.SSEResponse
+		if err := json.Unmarshal([]byte(payload), &message); err != nil {
+			log.Printf("Skipping unreadable queued message %s: %v", entry.ID, err)
+			continue
+		}
+		message.ID, message.Timestamp = entry.ID, queueIDMillis(entry.ID)
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// MarkSent records that a message has been written to the device. Only its ack moves the cursor,
+// so a message lost with the connection is replayed.
+func MarkSent(ctx context.Context, redisStore *redis.Client, deviceId string, id string) error {
+	if id == "" {
+		return nil
+	}
+	_, err := setMessageStatus(ctx, redisStore, deviceId, id, MessageStatusSent)
+	return err
+}
+
+// Moves the cursor over every acked or expired message right after it, stopping at the first
+// one the device still has to ack
+var advanceCursorScript = redis.NewScript(`
+local cursor = redis.call("GET", KEYS[2])
+local start = "-"
+if cursor then
+	start = "(" .. cursor
+end
+local moved = cursor
+for _, entry in ipairs(redis.call("XRANGE", KEYS[1], start, "+")) do
+	local status = redis.call("GET", ARGV[3] .. entry[1])
+	local millis = tonumber(string.match(entry[1], "^(%d+)"))
+	if status ~= "delivered" and status ~= "read" and millis >= tonumber(ARGV[2]) then
+		break
+	end
+	moved = entry[1]
+end
+if moved and moved ~= cursor then
+	redis.call("SET", KEYS[2], moved, "PX", ARGV[1])
+end
+return 1
+`)
+
+// advanceCursor moves the device's cursor after an ack
+func advanceCursor(ctx context.Context, redisStore *redis.Client, deviceId string) error {
+	keys := []string{queueKey(deviceId), queueCursorKey(deviceId)}
+	oldest := time.Now().Add(-messageTTL).UnixMilli()
+	return advanceCursorScript.Run(ctx, redisStore, keys, messageTTL.Milliseconds(), oldest, messageStatusKey(deviceId, "")).Err()
+}
+
+// queueIDAfter reports whether stream ID a comes after b, IDs are "<millis>-<sequence>"
+func queueIDAfter(a string, b string) bool {
+	if b == "" {
+		return true
+	}
+	aMillis, aSeq := splitQueueID(a)
+	bMillis, bSeq := splitQueueID(b)
+	if aMillis != bMillis {
+		return aMillis > bMillis
+	}
+	return aSeq > bSeq
+}
+
+func queueIDMillis(id string) int64 {
+	millis, _ := splitQueueID(id)
+	return millis
+}
+
+func splitQueueID(id string) (int64, int64) {
+	millisPart, seqPart, _ := strings.Cut(id, "-")
+	millis, _ := strconv.ParseInt(millisPart, 10, 64)
+	seq, _ := strconv.ParseInt(seqPart, 10, 64)
+	return millis, seq
+}
@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestQueueIDAfter tests the ordering of Redis stream IDs used to skip delivered messages
+func TestQueueIDAfter(t *testing.T) {
+	assert.True(t, queueIDAfter("1700000000000-0", ""))
+	assert.True(t, queueIDAfter("1700000000001-0", "1700000000000-5"))
+	assert.True(t, queueIDAfter("1700000000000-10", "1700000000000-9"))
+	assert.False(t, queueIDAfter("1700000000000-9", "1700000000000-9"))
+	assert.False(t, queueIDAfter("999999999999-0", "1700000000000-0"))
+}
+
+// TestSSEEvent tests that queued messages carry their stream ID for Last-Event-ID
+func TestSSEEvent(t *testing.T) {
+	assert.Equal(t, "data: {}\n\n", sseEvent("", "{}"))
+	assert.Equal(t, "id: 1-0\ndata: {}\n\n", sseEvent("1-0", "{}"))
+}
+
+// TestSetMessageStatusExpired tests that expired messages get no status, which would outlive them
+func TestSetMessageStatusExpired(t *testing.T) {
+	expired := strconv.FormatInt(time.Now().Add(-messageTTL-time.Minute).UnixMilli(), 10) + "-0"
+	changed, err := setMessageStatus(context.Background(), nil, "device", expired, MessageStatusDelivered)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "queue:status:device:"+expired, messageStatusKey("device", expired))
+}
@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Statuses a queued message moves through, in order
+const (
+	MessageStatusQueued    = "queued"
+	MessageStatusSent      = "sent"
+	MessageStatusDelivered = "delivered"
+	MessageStatusRead      = "read"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// Status of one message queued for a device, it expires along with the message so statuses don't
+// outlive the stream entries they belong to
+func messageStatusKey(deviceId string, id string) string {
+	return "queue:status:" + deviceId + ":" + id
+}
+
+// Only ever moves a message's status forward, so a late "delivered" ack can't undo "read"
+var setMessageStatusScript = redis.NewScript(`
+local ranks = {queued = 1, sent = 2, delivered = 3, read = 4}
+local current = redis.call("GET", KEYS[1])
+if current and ranks[current] >= ranks[ARGV[1]] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// setMessageStatus records a message's new status and reports whether it moved forward. Expired
+// messages keep no status.
+func setMessageStatus(ctx context.Context, redisStore *redis.Client, deviceId string, id string, status string) (bool, error) {
+	ttl := time.Until(time.UnixMilli(queueIDMillis(id)).Add(messageTTL)).Milliseconds()
+	if ttl <= 0 {
+		return false, nil
+	}
+	changed, err := setMessageStatusScript.Run(ctx, redisStore, []string{messageStatusKey(deviceId, id)},
+		status, ttl).Int()
+	return changed == 1, err
+}
+
+// messageStatuses reads the statuses of the device's queue entries, keyed by entry ID. Entries
+// without a status are left out.
+func messageStatuses(ctx context.Context, redisStore *redis.Client, deviceId string, entries []redis.XMessage) (map[string]string, error) {
+	statuses := map[string]string{}
+	if len(entries) == 0 {
+		return statuses, nil
+	}
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = messageStatusKey(deviceId, entry.ID)
+	}
+	values, err := redisStore.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		if status, ok := value.(string); ok {
+			statuses[entries[i].ID] = status
+		}
+	}
+	return statuses, nil
+}
+
+// AckMessage handles an ack frame from a device for a message queued for it and sends a receipt
+// to the message's sender, if it came from another device.
+func AckMessage(ctx context.Context, redisStore *redis.Client, device structs.Device, data json.RawMessage) error {
+	var ack structs.MessageAck
+	if err := json.Unmarshal(data, &ack); err != nil || ack.ID == "" {
+		return fmt.Errorf("invalid ack %s", data)
+	}
+	if ack.Status == "" {
+		ack.Status = MessageStatusDelivered
+	}
+	if ack.Status != MessageStatusDelivered && ack.Status != MessageStatusRead {
+		return fmt.Errorf("invalid ack status %q", ack.Status)
+	}
+
+	deviceId := device.ID.String()
+	entries, err := redisStore.XRange(ctx, queueKey(deviceId), ack.ID, ack.ID).Result()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return ErrMessageNotFound
+	}
+
+	changed, err := setMessageStatus(ctx, redisStore, deviceId, ack.ID, ack.Status)
+	if err != nil || !changed {
+		return err
+	}
+	if err := advanceCursor(ctx, redisStore, deviceId); err != nil {
+		return err
+	}
+
+	sender, _ := entries[0].Values["sender"].(string)
+	if sender == "" {
+		return nil
+	}
+	receipt, err := json.Marshal(structs.MessageReceipt{
+		ID:        ack.ID,
+		DeviceId:  deviceId,
+		Status:    ack.Status,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+	return DeliverToDevice(ctx, redisStore, sender, &structs.SSEResponse{
+		Type:   "receipt",
+		Data:   receipt,
+		Device: device,
+	})
+}
+
+// MessageStatuses lists the unexpired messages queued for a device, optionally only those one
+// sender sent and those in one of the given statuses
+func MessageStatuses(ctx context.Context, redisStore *redis.Client, deviceId string, senderId string, statuses ...string) ([]structs.MessageStatus, error) {
+	entries, err := redisStore.XRange(ctx, queueKey(deviceId), "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	current, err := messageStatuses(ctx, redisStore, deviceId, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, status := range statuses {
+		wanted[status] = true
+	}
+
+	oldest := time.Now().Add(-messageTTL).UnixMilli()
+	messages := []structs.MessageStatus{}
+	for _, entry := range entries {
+		if queueIDMillis(entry.ID) < oldest {
+			continue
+		}
+		status, ok := current[entry.ID]
+		if !ok {
+			status = MessageStatusQueued
+		}
+		if len(wanted) > 0 && !wanted[status] {
+			continue
+		}
+		eventType, _ := entry.Values["type"].(string)
+		sender, _ := entry.Values["sender"].(string)
+		if senderId != "" && sender != senderId {
+			continue
+		}
+		messages = append(messages, structs.MessageStatus{
+			ID:        entry.ID,
+			Type:      eventType,
+			SenderId:  sender,
+			Status:    status,
+			Timestamp: queueIDMillis(entry.ID),
+		})
+	}
+	return messages, nil
+}
+
+// DeviceMessages shows the messages queued for one of the caller's devices. ?status=undelivered
+// lists the ones the device hasn't acked yet. For any other device it shows the receipts of what
+// ?sender_id, one of the caller's devices, sent it.
+func DeviceMessages(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, _ := GetFromToken(c, "ID")
+	senderId := c.Query("sender_id")
+	query := db.Where("id = ? AND user_id = ?", c.Params("id"), userId)
+	if senderId != "" {
+		var sender structs.Device
+		if err := db.Where("id = ? AND user_id = ?", senderId, userId).First(&sender).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Sender device not found",
+			})
+		}
+		senderId = sender.ID.String()
+		query = db.Where("id = ?", c.Params("id"))
+	}
+	var device structs.Device
+	if err := query.First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	var statuses []string
+	switch status := c.Query("status"); status {
+	case "":
+	case "undelivered":
+		statuses = []string{MessageStatusQueued, MessageStatusSent}
+	case MessageStatusQueued, MessageStatusSent, MessageStatusDelivered, MessageStatusRead:
+		statuses = []string{status}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid status",
+		})
+	}
+
+	messages, err := MessageStatuses(c.Context(), redisStore, device.ID.String(), senderId, statuses...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read message queue",
+		})
+	}
+	return c.JSON(messages)
+}
+
+// AckDeviceMessage takes acks for one of the caller's devices over HTTP, for clients reading
+// /device/receive, which can't send frames back
+func AckDeviceMessage(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client) error {
+	userId, _ := GetFromToken(c, "ID")
+	var device structs.Device
+	if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	err := AckMessage(c.Context(), redisStore, device, c.Body())
+	if errors.Is(err, ErrMessageNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Message not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
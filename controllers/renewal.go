@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// How often the backend looks for host certs that are about to expire
+const renewalCheckInterval = 15 * time.Minute
+
+// StartCertRenewalNotifier periodically tells devices over their Redis channel that their
+// cert expires within the configured renew_before window or was signed by a CA on its way out,
+// and retires CAs whose overlap window has passed.
+func StartCertRenewalNotifier(ctx context.Context, db *gorm.DB, redisStore *redis.Client) {
+	ticker := time.NewTicker(renewalCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := retireDueCAs(db); err != nil {
+			log.Println("Error retiring CAs:", err)
+		}
+		if err := notifyExpiringCerts(ctx, db, redisStore); err != nil {
+			log.Println("Error notifying expiring certs:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func notifyExpiringCerts(ctx context.Context, db *gorm.DB, redisStore *redis.Client) error {
+	now := time.Now()
+
+	// Only the latest unrevoked cert of each device matters, older ones have already been replaced.
+	// Certs signed by a CA that is being rotated out need renewing no matter when they expire.
+	var hostCerts []structs.HostCertificate
+	err := db.Preload("Device").
+		Where("not_after > ?", now.Unix()).
+		Where("not_after <= ? OR ca_fingerprint IN (SELECT fingerprint FROM certificate_authorities WHERE status <> ?)", now.Add(networkConfig.renewBefore).Unix(), CAStatusActive).
+		Where("NOT EXISTS (SELECT 1 FROM host_certificates newer WHERE newer.device_id = host_certificates.device_id AND newer.not_after > host_certificates.not_after)").
+		Where("NOT EXISTS (SELECT 1 FROM cert_revocations r WHERE r.fingerprint = host_certificates.fingerprint)").
+		Find(&hostCerts).Error
+	if err != nil {
+		return err
+	}
+
+	for _, hostCert := range hostCerts {
+		// One notice per cert, even with several backend instances running
+		key := "nebula:renew-notice:" + hostCert.Fingerprint
+		first, err := redisStore.SetNX(ctx, key, now.Unix(), time.Until(time.Unix(hostCert.NotAfter, 0))).Result()
+		if err != nil {
+			return err
+		}
+		if !first {
+			continue
+		}
+
+		if err := sendRenewalNotice(ctx, redisStore, hostCert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequestCertRenewal asks the user's devices to renew their current cert right away, e.g.
+// because the firewall their cert was signed with no longer matches their contacts.
+func RequestCertRenewal(ctx context.Context, db *gorm.DB, redisStore *redis.Client, userId uuid.UUID) error {
+	devices := db.Model(&structs.Device{}).Select("id").Where("user_id = ? AND status = ?", userId, DeviceStatusApproved)
+	var hostCerts []structs.HostCertificate
+	err := db.Preload("Device").
+		Where("device_id IN (?) AND not_after > ?", devices, time.Now().Unix()).
+		Where("NOT EXISTS (SELECT 1 FROM host_certificates newer WHERE newer.device_id = host_certificates.device_id AND newer.not_after > host_certificates.not_after)").
+		Where("NOT EXISTS (SELECT 1 FROM cert_revocations r WHERE r.fingerprint = host_certificates.fingerprint)").
+		Find(&hostCerts).Error
+	if err != nil {
+		return err
+	}
+	for _, hostCert := range hostCerts {
+		if err := sendRenewalNotice(ctx, redisStore, hostCert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendRenewalNotice(ctx context.Context, redisStore *redis.Client, hostCert structs.HostCertificate) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"fingerprint":    hostCert.Fingerprint,
+		"not_after":      hostCert.NotAfter,
+		"ca_fingerprint": hostCert.CaFingerprint,
+	})
+	if err != nil {
+		return err
+	}
+	response := structs.SSEResponse{
+		Type:   "cert_renewal",
+		Data:   data,
+		Device: hostCert.Device,
+	}
+
+	// Queued so devices that are offline right now still renew when they reconnect
+	log.Printf("Asking device %s to renew cert %s", hostCert.DeviceId, hostCert.Fingerprint)
+	return DeliverToDevice(ctx, redisStore, hostCert.DeviceId.String(), &response)
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+	structs "zeroshare-backend/structs"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Redis channel every connected /stream client listens on for mesh wide updates
+const BlocklistChannel = "nebula:blocklist"
+
+var ErrCertificateNotFound = errors.New("certificate not found")
+
+// RevokeCertificate revokes a host cert issued to one of the user's devices.
+func RevokeCertificate(db *gorm.DB, redisStore *redis.Client, userId string, fingerprint string, reason string) error {
+	var hostCert structs.HostCertificate
+	err := db.Joins("JOIN devices ON devices.id = host_certificates.device_id").
+		Where("host_certificates.fingerprint = ? AND devices.user_id = ?", fingerprint, userId).
+		First(&hostCert).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrCertificateNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := revoke(db, []structs.HostCertificate{hostCert}, reason); err != nil {
+		return err
+	}
+	return SyncBlocklist(db, redisStore)
+}
+
+// RevokeDeviceCertificates revokes every unexpired cert issued to the device, e.g. when it is lost.
+func RevokeDeviceCertificates(db *gorm.DB, redisStore *redis.Client, deviceId uuid.UUID, reason string) ([]string, error) {
+	var hostCerts []structs.HostCertificate
+	if err := db.Where("device_id = ? AND not_after > ?", deviceId, time.Now().Unix()).Find(&hostCerts).Error; err != nil {
+		return nil, err
+	}
+
+	fingerprints := []string{}
+	for _, hostCert := range hostCerts {
+		fingerprints = append(fingerprints, hostCert.Fingerprint)
+	}
+	if len(hostCerts) == 0 {
+		return fingerprints, nil
+	}
+
+	if err := revoke(db, hostCerts, reason); err != nil {
+		return nil, err
+	}
+	return fingerprints, SyncBlocklist(db, redisStore)
+}
+
+// RevokeUserCertificates revokes every unexpired cert issued to the users' devices, e.g. when
+// they leave an organization whose group their certs carry.
+func RevokeUserCertificates(db *gorm.DB, redisStore *redis.Client, userIds []uuid.UUID, reason string) error {
+	if len(userIds) == 0 {
+		return nil
+	}
+	devices := db.Model(&structs.Device{}).Select("id").Where("user_id IN ?", userIds)
+	var hostCerts []structs.HostCertificate
+	if err := db.Where("device_id IN (?) AND not_after > ?", devices, time.Now().Unix()).Find(&hostCerts).Error; err != nil {
+		return err
+	}
+	if len(hostCerts) == 0 {
+		return nil
+	}
+
+	if err := revoke(db, hostCerts, reason); err != nil {
+		return err
+	}
+	return SyncBlocklist(db, redisStore)
+}
+
+func revoke(db *gorm.DB, hostCerts []structs.HostCertificate, reason string) error {
+	revocations := []structs.CertRevocation{}
+	for _, hostCert := range hostCerts {
+		deviceId := hostCert.DeviceId
+		revocations = append(revocations, structs.CertRevocation{
+			Fingerprint: hostCert.Fingerprint,
+			DeviceId:    &deviceId,
+			Reason:      reason,
+			NotAfter:    hostCert.NotAfter,
+		})
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&revocations).Error
+}
+
+// Blocklist returns the fingerprints of revoked certs that have not expired yet.
+func Blocklist(db *gorm.DB) ([]string, error) {
+	fingerprints := []string{}
+	err := db.Model(&structs.CertRevocation{}).
+		Where("not_after > ?", time.Now().Unix()).
+		Order("created").
+		Pluck("fingerprint", &fingerprints).Error
+	return fingerprints, err
+}
+
+// SyncBlocklist regenerates pki.blocklist in the lighthouse config and tells connected clients about it.
+func SyncBlocklist(db *gorm.DB, redisStore *redis.Client) error {
+	fingerprints, err := Blocklist(db)
+	if err != nil {
+		return err
+	}
+
+	if err := mergeLighthouseConfig("pki", map[string]interface{}{"blocklist": fingerprints}); err != nil {
+		// The revocation is stored, so clients still get the update even if the file can't be written
+		log.Printf("Failed to write lighthouse blocklist: %v", err)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"blocklist": fingerprints})
+	if err != nil {
+		return err
+	}
+	response, err := json.Marshal(structs.SSEResponse{
+		Type: "blocklist_update",
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+	return redisStore.Publish(context.Background(), BlocklistChannel, response).Err()
+}
@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+	"zeroshare-backend/middlewares"
+	structs "zeroshare-backend/structs"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	accessTokenTTL = 72 * time.Hour
+	// Sessions expire after this long without a refresh
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+func newRefreshToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// storeRefreshToken adds a new refresh token to the session and returns it
+func storeRefreshToken(db *gorm.DB, session structs.Session) (string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	err = db.Create(&structs.RefreshToken{
+		SessionId: session.ID,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: session.ExpiresAt,
+	}).Error
+	return token, err
+}
+
+// startSession records a new login by the client making the request and issues its first tokens
+func startSession(c *fiber.Ctx, db *gorm.DB, user structs.User) (structs.TokenResponse, error) {
+	return createSession(db, user, c.Get(fiber.HeaderUserAgent), c.IP())
+}
+
+// createSession records a new login by a client other than the one making the request
+func createSession(db *gorm.DB, user structs.User, userAgent string, ipAddress string) (structs.TokenResponse, error) {
+	now := time.Now()
+	session := structs.Session{
+		UserId:    user.ID,
+		UserAgent: userAgent,
+		IpAddress: ipAddress,
+		LastUsed:  now.Unix(),
+		ExpiresAt: now.Add(refreshTokenTTL).Unix(),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return structs.TokenResponse{}, err
+	}
+	return createToken(db, user, session)
+}
+
+// rotateRefreshToken uses up a refresh token and extends its session. A token that was already
+// used has been copied somewhere, so its whole session is revoked.
+func rotateRefreshToken(db *gorm.DB, token string) (structs.Session, error) {
+	var stored structs.RefreshToken
+	if err := db.Preload("Session").Where("token_hash = ?", hashRefreshToken(token)).First(&stored).Error; err != nil {
+		return structs.Session{}, ErrInvalidRefreshToken
+	}
+
+	now := time.Now().Unix()
+	session := stored.Session
+	if session.RevokedAt != nil || session.ExpiresAt < now || stored.ExpiresAt < now {
+		return session, ErrInvalidRefreshToken
+	}
+
+	// Conditional so two requests racing with the same token can't both win
+	result := db.Model(&structs.RefreshToken{}).Where("id = ? AND used_at IS NULL", stored.ID).Update("used_at", now)
+	if result.Error != nil {
+		return session, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if err := revokeSessions(db.Where("id = ?", session.ID)); err != nil {
+			log.Println("Failed to revoke session:", err)
+		}
+		return session, ErrRefreshTokenReused
+	}
+
+	session.LastUsed = now
+	session.ExpiresAt = time.Now().Add(refreshTokenTTL).Unix()
+	err := db.Model(&session).Updates(map[string]interface{}{
+		"last_used":  session.LastUsed,
+		"expires_at": session.ExpiresAt,
+	}).Error
+	if err != nil {
+		return session, err
+	}
+
+	// Used tokens are only kept to catch reuse, which can't happen once they've expired
+	if err := db.Where("session_id = ? AND expires_at < ?", session.ID, now).Delete(&structs.RefreshToken{}).Error; err != nil {
+		log.Println("Failed to prune refresh tokens:", err)
+	}
+	return session, nil
+}
+
+// revokeSessions revokes the sessions query selects, which stops their refresh tokens and
+// access tokens at once
+func revokeSessions(query *gorm.DB) error {
+	return query.Model(&structs.Session{}).Where("revoked_at IS NULL").Update("revoked_at", time.Now().Unix()).Error
+}
+
+// RejectRevoked stops tokens that haven't expired yet but whose user has been suspended, lost the
+// admin role the token claims or whose session has been logged out. Tokens from before sessions
+// existed carry no sid and only get the user checks.
+func RejectRevoked(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	var user structs.User
+	err := db.Where("id = ?", userId).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if user.Suspended {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Account suspended",
+		})
+	}
+	// A refresh signs the current role into a new token
+	if err == nil && IsAdmin(c) && userRole(user) != middlewares.RoleAdmin {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Role has changed, refresh the token",
+		})
+	}
+
+	if sessionId, _ := GetFromToken(c, "sid"); sessionId != nil {
+		var active int64
+		err := db.Model(&structs.Session{}).
+			Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionId, userId).
+			Count(&active).Error
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if active == 0 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Session has been revoked",
+			})
+		}
+	}
+	return c.Next()
+}
+
+// Logout revokes the caller's session
+func Logout(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	sessionId, _ := GetFromToken(c, "sid")
+	if sessionId == nil {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	if err := revokeSessions(db.Where("id = ? AND user_id = ?", sessionId, userId)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ListSessions shows the caller's active sessions, most recently used first
+func ListSessions(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	sessionId, _ := GetFromToken(c, "sid")
+
+	var sessions []structs.Session
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, time.Now().Unix()).
+		Order("last_used DESC").Find(&sessions).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	response := make([]structs.SessionResponse, len(sessions))
+	for i, session := range sessions {
+		response[i] = structs.SessionResponse{
+			Session: session,
+			Current: session.ID.String() == sessionId,
+		}
+	}
+	return c.JSON(response)
+}
+
+func RevokeSession(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	var session structs.Session
+	err := db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Params("id"), userId).First(&session).Error
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Session not found",
+		})
+	}
+	if err := revokeSessions(db.Where("id = ?", session.ID)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RevokeOtherSessions logs the caller out everywhere except the session making the request
+func RevokeOtherSessions(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	query := db.Where("user_id = ?", userId)
+	if sessionId, _ := GetFromToken(c, "sid"); sessionId != nil {
+		query = query.Where("id <> ?", sessionId)
+	}
+	if err := revokeSessions(query); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
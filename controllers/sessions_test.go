@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRefreshTokenHash tests that refresh tokens are random and only their hash gets stored
+func TestRefreshTokenHash(t *testing.T) {
+	first, err := newRefreshToken()
+	assert.NoError(t, err)
+	second, err := newRefreshToken()
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, hashRefreshToken(first), hashRefreshToken(first))
+	assert.NotEqual(t, hashRefreshToken(first), hashRefreshToken(second))
+	assert.NotContains(t, hashRefreshToken(first), first)
+	assert.Len(t, hashRefreshToken(first), 64)
+}
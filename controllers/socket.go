@@ -3,45 +3,124 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	structs "zeroshare-backend/structs"
 
 	"github.com/gofiber/contrib/websocket"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
 )
 
-func Stream(c *websocket.Conn, redisStore *redis.Client) {
-	// Context for Redis operations
-	ctx := context.Background()
+// StreamDevice reads the device a /stream client sends as its first frame. Only the ID is used,
+// the rest is loaded from the database and the device has to belong to the authenticated user.
+func StreamDevice(c *websocket.Conn, db *gorm.DB) (structs.Device, error) {
+	var claimed structs.Device
+	if err := c.ReadJSON(&claimed); err != nil {
+		return claimed, err
+	}
+
 	var device structs.Device
-	if err := c.ReadJSON(&device); err != nil {
-		log.Println("Error reading device info:", err)
-		c.Close()
-		return
+	err := db.Where("id = ? AND user_id = ?", claimed.ID, c.Locals("userId")).First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return device, fmt.Errorf("device %s does not belong to the user", claimed.ID)
+	}
+	return device, err
+}
+
+// CanSendToDevice reports whether the user may send messages to the device with the given ID,
+// which has to be their own, an accepted contact's or a fellow organization member's. peer is
+// set when the device belongs to someone else.
+func CanSendToDevice(db *gorm.DB, userId interface{}, deviceId string) (allowed bool, peer bool, err error) {
+	id, err := uuid.Parse(deviceId)
+	if err != nil {
+		return false, false, nil
+	}
+	var target structs.Device
+	err = db.Select("user_id").Where("id = ?", id).First(&target).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if target.UserId.String() == fmt.Sprint(userId) {
+		return true, false, nil
+	}
+	allowed, err = areContacts(db, userId, target.UserId)
+	if err == nil && !allowed {
+		allowed, err = sameOrganization(db, userId, target.UserId)
 	}
+	return allowed, allowed, err
+}
+
+// Messages a device sends over /stream to answer another device's approval request
+var streamDeviceDecisions = map[string]string{
+	"device_approve": DeviceStatusApproved,
+	"device_reject":  DeviceStatusRejected,
+}
+
+func Stream(c *websocket.Conn, db *gorm.DB, device structs.Device, redisStore *redis.Client) {
+	// Context for Redis operations
+	ctx := context.Background()
 
 	deviceID := device.ID.String()
 	log.Printf("Device connected: %s", deviceID)
 
-	// Subscribe to Redis channel for the device
-	subscriber := redisStore.Subscribe(context.Background(), deviceID)
+	// Subscribe to Redis channel for the device, plus mesh wide blocklist updates
+	subscriber := redisStore.Subscribe(context.Background(), deviceID, BlocklistChannel)
 	defer subscriber.Close()
 
+	// Wait for the subscription so nothing published while the queue is replayed is missed
+	if _, err := subscriber.Receive(ctx); err != nil {
+		log.Println("Error subscribing to Redis:", err)
+		return
+	}
+
 	// Listen for messages on the Redis channel
 	// Goroutine to handle incoming messages from Redis
 	go func() {
+		// Catch up on messages queued while the device was offline first
+		lastId := c.Query("last_id")
+		queued, err := QueuedMessages(ctx, redisStore, deviceID, lastId)
+		if err != nil {
+			log.Println("Error reading queued messages:", err)
+		}
+		for _, message := range queued {
+			if err := c.WriteJSON(message); err != nil {
+				log.Println("Error writing JSON to WebSocket:", err)
+				return
+			}
+			lastId = message.ID
+			if err := MarkSent(ctx, redisStore, deviceID, lastId); err != nil {
+				log.Println("Error updating message status:", err)
+			}
+		}
+
 		for msg := range subscriber.Channel() {
 			var response structs.SSEResponse
 			if err := json.Unmarshal([]byte(msg.Payload), &response); err != nil {
 				log.Println("Error unmarshaling Redis message:", err)
 				continue
 			}
+			// Already sent while replaying the queue
+			if response.ID != "" && !queueIDAfter(response.ID, lastId) {
+				continue
+			}
 
 			// Send the message to the WebSocket client
 			if err := c.WriteJSON(response); err != nil {
 				log.Println("Error writing JSON to WebSocket:", err)
 				break
 			}
+			if response.ID != "" {
+				lastId = response.ID
+				if err := MarkSent(ctx, redisStore, deviceID, lastId); err != nil {
+					log.Println("Error updating message status:", err)
+				}
+			}
 		}
 	}()
 
@@ -53,23 +132,52 @@ func Stream(c *websocket.Conn, redisStore *redis.Client) {
 			break
 		}
 
-		// Create SSEResponse to publish to Redis
+		// Acks are for the backend, they turn into receipts for the message's sender
+		if request.Type == "ack" {
+			if err := AckMessage(ctx, redisStore, device, request.Data); err != nil {
+				log.Println("Error handling ack:", err)
+			}
+			continue
+		}
+
+		if status, ok := streamDeviceDecisions[request.Type]; ok {
+			if err := StreamDeviceDecision(db, redisStore, device, request.DeviceID, status); err != nil {
+				log.Printf("Device %s failed to answer approval of %q: %v", deviceID, request.DeviceID, err)
+				rejected, _ := json.Marshal(structs.SSEResponse{
+					Type: "error",
+					Data: json.RawMessage(`{"error":"Could not answer the approval request"}`),
+				})
+				redisStore.Publish(ctx, deviceID, rejected)
+			}
+			continue
+		}
+
+		allowed, peer, err := CanSendToDevice(db, device.UserId, request.DeviceID)
+		if err != nil || !allowed {
+			log.Printf("Device %s may not send to %q", deviceID, request.DeviceID)
+			// Goes through the device's own channel so only the goroutine above writes to the socket
+			rejected, _ := json.Marshal(structs.SSEResponse{
+				Type: "error",
+				Data: json.RawMessage(`{"error":"Not allowed to send to this device"}`),
+			})
+			redisStore.Publish(ctx, deviceID, rejected)
+			continue
+		}
+
+		// Create SSEResponse to queue for the target device
 		response := structs.SSEResponse{
 			Type:   request.Type,
 			Data:   request.Data,
 			Device: device,
 		}
-
-		// Publish to Redis
-		responseData, err := json.Marshal(response)
-		if err != nil {
-			log.Println("Error marshaling response:", err)
-			continue
+		if peer {
+			response.Device = PeerView(device)
 		}
-		if err := redisStore.Publish(ctx, request.DeviceID, responseData).Err(); err != nil {
-			log.Println("Error publishing to Redis:", err)
+
+		if err := RelayMessage(ctx, redisStore, deviceID, request.DeviceID, &response); err != nil {
+			log.Println("Error queueing message:", err)
 			continue
 		}
-		log.Printf("Published to Redis channel %s: %s", request.DeviceID, responseData)
+		log.Printf("Queued message %s for device %s", response.ID, request.DeviceID)
 	}
 }
\ No newline at end of file
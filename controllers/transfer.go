@@ -3,52 +3,221 @@ package controllers
 import (
 	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+	structs "zeroshare-backend/structs"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
 	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
 )
 
-func DeviceSSE(c *fiber.Ctx, redisStore *redis.Client, deviceId string) error {
+// How long a signed receive URL can be used to open a stream, the stream itself stays open
+const receiveURLTTL = 5 * time.Minute
+
+// SignReceiveURL signs the /device/receive URL of a device for clients like EventSource that can't
+// send an Authorization header. It returns the expiry and signature query params.
+func SignReceiveURL(deviceId string, expires time.Time) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", receiveURLSignature(deviceId, expires.Unix()))
+	return query.Encode()
+}
+
+// receiveURLKey signs receive URLs, it's derived from AUTH_SECRET so the secret itself is never
+// used as a MAC key
+var receiveURLKey []byte
+
+// InitReceiveURLKey derives the receive URL key. The receive path skips auth, so the backend
+// refuses to start without AUTH_SECRET rather than sign URLs anyone could forge.
+func InitReceiveURLKey() error {
+	secret := os.Getenv("AUTH_SECRET")
+	if secret == "" {
+		return errors.New("AUTH_SECRET is not set")
+	}
+	key := sha256.Sum256([]byte("device-receive:" + secret))
+	receiveURLKey = key[:]
+	return nil
+}
+
+func receiveURLSignature(deviceId string, expires int64) string {
+	mac := hmac.New(sha256.New, receiveURLKey)
+	fmt.Fprintf(mac, "device-receive:%s:%d", deviceId, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyReceiveURL checks the expires and sig params of a signed receive URL
+func verifyReceiveURL(deviceId string, expiresParam string, sig string) bool {
+	if len(receiveURLKey) == 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := receiveURLSignature(deviceId, expires)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
+
+// ReceiveURL hands out a short-lived signed URL for one of the caller's devices
+func ReceiveURL(c *fiber.Ctx, db *gorm.DB) error {
+	userId, _ := GetFromToken(c, "ID")
+	var device structs.Device
+	if err := db.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Device not found",
+		})
+	}
+
+	expires := time.Now().Add(receiveURLTTL)
+	return c.JSON(fiber.Map{
+		"url":     fmt.Sprintf("/device/receive/%s?%s", device.ID, SignReceiveURL(device.ID.String(), expires)),
+		"expires": expires.Unix(),
+	})
+}
+
+// DeviceSSE streams a device's messages. Callers either own the device, going by their JWT, or
+// present a signed URL from ReceiveURL.
+func DeviceSSE(c *fiber.Ctx, db *gorm.DB, redisStore *redis.Client, deviceId string) error {
+	var device structs.Device
+	if err := db.Where("id = ?", deviceId).First(&device).Error; err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Not allowed to receive for this device",
+		})
+	}
+
+	allowed := false
+	if sig := c.Query("sig"); sig != "" {
+		allowed = verifyReceiveURL(device.ID.String(), c.Query("expires"), sig)
+	} else if userId, err := GetFromToken(c, "ID"); err == nil {
+		allowed = userId == device.UserId.String()
+	}
+	if !allowed {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Not allowed to receive for this device",
+		})
+	}
 
 	c.Set("Content-Type", "text/event-stream")
 	c.Set("Cache-Control", "no-cache")
 	c.Set("Connection", "keep-alive")
 	c.Set("Transfer-Encoding", "chunked")
 
+	// Browsers resend the id of the last event they got as Last-Event-ID when reconnecting
+	lastId := c.Get("Last-Event-ID", c.Query("last_id"))
+
 	subscriber := redisStore.Subscribe(context.Background(), deviceId)
+	// Wait for the subscription so nothing published while the queue is replayed is missed
+	if _, err := subscriber.Receive(context.Background()); err != nil {
+		subscriber.Close()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to subscribe",
+		})
+	}
 
 	// Listen for messages on the Redis channel and send them as SSE
 	c.Status(fiber.StatusOK).Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
-		for {
-			msg, err := subscriber.ReceiveMessage(context.Background())
+		ctx := context.Background()
+		defer subscriber.Close()
+
+		if err := MarkConnected(ctx, db, redisStore, device); err != nil {
+			log.Printf("Error updating presence: %v", err)
+		}
+		defer func() {
+			if err := MarkOffline(ctx, db, redisStore, device); err != nil {
+				log.Printf("Error updating presence: %v", err)
+			}
+		}()
+
+		// Catch up on messages queued while the device was offline first
+		queued, err := QueuedMessages(ctx, redisStore, deviceId, lastId)
+		if err != nil {
+			log.Printf("Error reading queued messages: %v", err)
+		}
+		for _, message := range queued {
+			payload, err := json.Marshal(message)
 			if err != nil {
-				log.Printf("Error receiving message: %v", err)
-				break
+				continue
+			}
+			if err := writeSSE(w, sseEvent(message.ID, string(payload))); err != nil {
+				log.Printf("Error writing to stream: %v", err)
+				return
+			}
+			lastId = message.ID
+			if err := MarkSent(ctx, redisStore, deviceId, lastId); err != nil {
+				log.Printf("Error updating message status: %v", err)
 			}
+		}
 
-			// Send the SSE formatted data
-			log.Printf("Sending SSE event to client: %s", deviceId)
-			data := fmt.Sprintf("data: %s\n\n", msg.Payload)
+		// Comments keep the connection alive and tell us when the client has gone away
+		ticker := time.NewTicker(PresenceHeartbeatInterval)
+		defer ticker.Stop()
 
-			log.Printf("Payload: %s", msg.Payload)
+		messages := subscriber.Channel()
+		for {
+			var data, id string
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					log.Printf("Subscription closed for %s", deviceId)
+					return
+				}
+				var response structs.SSEResponse
+				if err := json.Unmarshal([]byte(msg.Payload), &response); err == nil {
+					id = response.ID
+				}
+				// Already sent while replaying the queue
+				if id != "" && !queueIDAfter(id, lastId) {
+					continue
+				}
+				// Send the SSE formatted data
+				log.Printf("Sending SSE event to client: %s", deviceId)
+				data = sseEvent(id, msg.Payload)
+				log.Printf("Payload: %s", msg.Payload)
+			case <-ticker.C:
+				data = ": ping\n\n"
+				if err := MarkOnline(ctx, db, redisStore, device); err != nil {
+					log.Printf("Error updating presence: %v", err)
+				}
+			}
 
-			// Write data to the stream
-			if _, err := w.WriteString(data); err != nil {
+			if err := writeSSE(w, data); err != nil {
 				log.Printf("Error writing to stream: %v", err)
-				break
+				return
 			}
-
-			// Flush the response to send the data immediately
-			if err := w.Flush(); err != nil {
-				log.Printf("Error flushing stream: %v", err)
-				break
+			if id != "" {
+				lastId = id
+				if err := MarkSent(ctx, redisStore, deviceId, lastId); err != nil {
+					log.Printf("Error updating message status: %v", err)
+				}
 			}
-			log.Println("Received message:", msg.Payload)
 		}
 	}))
 
 	return nil
-}
\ No newline at end of file
+}
+
+func sseEvent(id string, payload string) string {
+	if id == "" {
+		return fmt.Sprintf("data: %s\n\n", payload)
+	}
+	return fmt.Sprintf("id: %s\ndata: %s\n\n", id, payload)
+}
+
+// writeSSE writes data to the stream and flushes it so it's sent immediately
+func writeSSE(w *bufio.Writer, data string) error {
+	if _, err := w.WriteString(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
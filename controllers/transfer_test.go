@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReceiveURLSignature tests that signed receive URLs only work for their device until they expire
+func TestReceiveURLSignature(t *testing.T) {
+	t.Setenv("AUTH_SECRET", "test-secret")
+	assert.NoError(t, InitReceiveURLKey())
+	deviceId := "3f0c6a52-63a4-4bb6-9a0e-8b2f0f6a8d11"
+
+	query, err := url.ParseQuery(SignReceiveURL(deviceId, time.Now().Add(receiveURLTTL)))
+	assert.NoError(t, err)
+
+	assert.True(t, verifyReceiveURL(deviceId, query.Get("expires"), query.Get("sig")))
+	assert.False(t, verifyReceiveURL("a2c1f7f4-0000-4000-8000-000000000000", query.Get("expires"), query.Get("sig")), "other device")
+	assert.False(t, verifyReceiveURL(deviceId, query.Get("expires"), "forged"), "bad signature")
+
+	expired, err := url.ParseQuery(SignReceiveURL(deviceId, time.Now().Add(-time.Second)))
+	assert.NoError(t, err)
+	assert.False(t, verifyReceiveURL(deviceId, expired.Get("expires"), expired.Get("sig")), "expired")
+}
+
+// TestInitReceiveURLKey tests that receive URLs can't be signed with an empty secret
+func TestInitReceiveURLKey(t *testing.T) {
+	t.Setenv("AUTH_SECRET", "")
+	receiveURLKey = nil
+	assert.Error(t, InitReceiveURLKey())
+
+	query, err := url.ParseQuery(SignReceiveURL("3f0c6a52-63a4-4bb6-9a0e-8b2f0f6a8d11", time.Now().Add(receiveURLTTL)))
+	assert.NoError(t, err)
+	assert.False(t, verifyReceiveURL("3f0c6a52-63a4-4bb6-9a0e-8b2f0f6a8d11", query.Get("expires"), query.Get("sig")))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 
 	"log"
 	"net/url"
@@ -36,8 +37,11 @@ func shoudSkipPath(c *fiber.Ctx) bool {
 	path := c.Path()
 
 	// Handle dynamic routes manually (e.g., /login/qr/:token)
-	if path == "/oauth/google" || path == "/auth/google/callback" ||
+	if path == "/oauth/google" || path == "/.well-known/jwks.json" ||
 		strings.HasPrefix(path, "/login/") ||
+		path == "/oauth/device/code" || path == "/oauth/token" ||
+		strings.HasPrefix(path, "/auth/") ||
+		strings.HasPrefix(path, "/activate") ||
 		strings.HasPrefix(path, "/proxy/") ||
 		strings.HasPrefix(path, "/refresh") ||
 		strings.HasPrefix(path, "/stream") ||
@@ -45,6 +49,10 @@ func shoudSkipPath(c *fiber.Ctx) bool {
 		strings.HasPrefix(path, "/sse/") {
 		return true
 	}
+	// Signed receive URLs carry their own authorization, checked in DeviceSSE
+	if strings.HasPrefix(path, "/device/receive/") && c.Query("sig") != "" {
+		return true
+	}
 	return false
 }
 
@@ -75,8 +83,7 @@ func main() {
 
 	// Register SSE endpoint before other middleware
 	app.Get("/sse/:sessionToken", func(c *fiber.Ctx) error {
-		sessionToken := c.Params("sessionToken")
-		return controller.SSE(c, redisStore, sessionToken)
+		return controller.LoginSessionStream(c, redisStore)
 	})
 
 	app.Use(otelfiber.Middleware())
@@ -91,14 +98,20 @@ func main() {
 
 	app.Static("/assets", "./assets")
 
+	if err := controller.InitReceiveURLKey(); err != nil {
+		log.Fatal(err)
+	}
 	DB = controller.InitDatabase()
-	// go pb.StartGRPCServer(DB)
+	controller.InitJWTKeys(DB)
+	// go pb.StartGRPCServer(DB, redisStore)
 
-	controller.InitNebula(context.Background())
+	controller.InitNetworkConfig()
+	controller.InitNebula(context.Background(), DB)
+	controller.InitIPAM(DB)
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*", // Adjust this to allow only specific origins if needed
-		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
+		AllowMethods: "GET,POST,PUT,PATCH,DELETE,OPTIONS",
 		AllowHeaders: "Authorization, Content-Type, Accept",
 	}))
 
@@ -109,7 +122,16 @@ func main() {
 			return c.Next()
 		}
 		// Otherwise, apply JWT middleware
-		return middlewares.NewAuthMiddleware(os.Getenv("AUTH_SECRET"))(c)
+		return middlewares.NewAuthMiddleware(controller.JWTKeyfunc)(c)
+	})
+
+	// A signature alone isn't enough, tokens of logged out sessions, suspended users and demoted
+	// admins are turned away before they expire
+	app.Use(func(c *fiber.Ctx) error {
+		if shoudSkipPath(c) {
+			return c.Next()
+		}
+		return controller.RejectRevoked(c, DB)
 	})
 
 	app.Use("/stream", func(c *fiber.Ctx) error {
@@ -121,25 +143,74 @@ func main() {
 			return c.Next()
 		}
 		return fiber.ErrUpgradeRequired
+	}, middlewares.NewStreamAuthMiddleware(controller.JWTKeyfunc), func(c *fiber.Ctx) error {
+		// The websocket connection only keeps locals, so hand it the caller's user ID
+		userId, err := controller.GetFromToken(c, "ID")
+		if err != nil || userId == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User ID not found in token",
+			})
+		}
+		c.Locals("userId", userId)
+		return c.Next()
+	}, func(c *fiber.Ctx) error {
+		return controller.RejectRevoked(c, DB)
 	})
 
-	oauthConf := controller.SetUpOAuth()
+	controller.InitIdentityProviders(context.Background())
+	controller.InitMailer()
 
 	redisStore = controller.SetupRedis()
+	controller.InitMessageQueue()
+
+	if err := controller.SyncBlocklist(DB, redisStore); err != nil {
+		log.Println("Failed to sync certificate blocklist:", err)
+	}
+	go controller.StartCertRenewalNotifier(context.Background(), DB, redisStore)
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Hello, World!")
 	})
 
+	app.Get("/.well-known/jwks.json", controller.JWKS)
+
+	app.Get("/auth/providers", controller.ListIdentityProviders)
+
+	// Clients start every sign in here, with the PKCE challenge for the verifier they send to /sse
+	app.Post("/login/session", func(c *fiber.Ctx) error {
+		return controller.CreateLoginSession(c, redisStore)
+	})
+
+	// Registered before /login/:provider/:token, which would match them too
+	app.Post("/login/qr/:token", func(c *fiber.Ctx) error {
+		return controller.StartQRLogin(c, redisStore)
+	})
+
+	app.Post("/login/email", func(c *fiber.Ctx) error {
+		return controller.StartEmailLogin(c, redisStore)
+	})
+
+	app.Post("/login/email/verify", func(c *fiber.Ctx) error {
+		return controller.VerifyEmailCode(c, DB, redisStore)
+	})
+
+	app.Get("/login/email/link", controller.ConfirmEmailLink)
+
+	app.Post("/login/email/link", func(c *fiber.Ctx) error {
+		return controller.VerifyEmailLink(c, DB, redisStore)
+	})
+
+	// Sign in with Google, from before other providers were supported
 	app.Get("/login/:token", func(c *fiber.Ctx) error {
-		sessionToken := c.Params("token")
-		url := oauthConf.AuthCodeURL(sessionToken)
-		return c.Redirect(url)
+		return controller.LoginRedirect(c, redisStore, "google", c.Params("token"))
 	})
 
-	app.Get("auth/google/callback", func(c *fiber.Ctx) error {
-		//get code from query params for generating token
-		return controller.GetAuthData(c, oauthConf, DB, redisStore)
+	app.Get("/login/:provider/:token", func(c *fiber.Ctx) error {
+		return controller.LoginRedirect(c, redisStore, c.Params("provider"), c.Params("token"))
+	})
+
+	app.Get("/auth/:provider/callback", func(c *fiber.Ctx) error {
+		return controller.ProviderCallback(c, DB, redisStore)
 	})
 
 	app.Post("/device", func(c *fiber.Ctx) error {
@@ -171,31 +242,90 @@ func main() {
 		// Assign the parsed user ID to the response struct
 		response.UserId = uid
 
+		// New devices may have to be approved by one of the user's devices first
+		status, err := controller.InitialDeviceStatus(DB, uid)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		response.Status = status
+
 		// Query the database and handle any potential errors
-		if err := DB.Where("device_id = ?", response.DeviceId).FirstOrCreate(&response).Error; err != nil {
+		result := DB.Where("device_id = ?", response.DeviceId).FirstOrCreate(&response)
+		if result.Error != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Database error",
 			})
 		}
 
+		if response.Status == controller.DeviceStatusPending {
+			if result.RowsAffected > 0 {
+				if err := controller.RequestDeviceApproval(DB, redisStore, *response); err != nil {
+					log.Println("Failed to request device approval:", err)
+				}
+			}
+			return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+				"status": response.Status,
+			})
+		}
+
 		return c.SendStatus(fiber.StatusOK)
 	})
 
+	// RFC 8628 device authorization grant for clients without a browser
+	app.Post("/oauth/device/code", func(c *fiber.Ctx) error {
+		return controller.DeviceAuthorization(c, redisStore)
+	})
+
+	app.Post("/oauth/token", func(c *fiber.Ctx) error {
+		return controller.DeviceToken(c, DB, redisStore)
+	})
+
+	app.Get("/oauth/device/:userCode", func(c *fiber.Ctx) error {
+		return controller.GetDeviceCode(c, redisStore)
+	})
+
+	app.Post("/oauth/device/approve", func(c *fiber.Ctx) error {
+		return controller.ApproveDeviceCode(c, redisStore)
+	})
+
+	app.Post("/oauth/device/deny", func(c *fiber.Ctx) error {
+		return controller.DenyDeviceCode(c, redisStore)
+	})
+
+	app.Get("/activate", controller.ActivatePage)
+
+	app.Get("/activate/:provider", func(c *fiber.Ctx) error {
+		return controller.ActivateWithProvider(c, redisStore)
+	})
+
 	app.Get("/devices", func(c *fiber.Ctx) error {
-		userId, _ := controller.GetFromToken(c, "ID")
-		devices := []*structs.Device{}
-		DB.Where("user_id = ?", userId).Find(&devices)
-		return c.JSON(devices)
+		return controller.ListDevices(c, DB, redisStore)
+	})
+
+	app.Get("/devices/:id", func(c *fiber.Ctx) error {
+		return controller.GetDevice(c, DB, redisStore)
+	})
+
+	app.Patch("/devices/:id", func(c *fiber.Ctx) error {
+		return controller.UpdateDevice(c, DB)
+	})
+
+	app.Delete("/devices/:id", func(c *fiber.Ctx) error {
+		return controller.DeleteDevice(c, DB, redisStore)
 	})
 
 	app.Post("/login/verify-google", func(c *fiber.Ctx) error {
-		response := new(structs.GoogleTokenResponse)
+		response := new(structs.ProviderTokenRequest)
 		json.Unmarshal(c.Body(), response)
-		tokenResponse, err := controller.GetAuthDataFromGooglePayload(response.Token, DB)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
-		}
-		return c.JSON(tokenResponse)
+		return controller.VerifyProviderToken(c, DB, "google", response.Token)
+	})
+
+	app.Post("/login/:provider/verify", func(c *fiber.Ctx) error {
+		response := new(structs.ProviderTokenRequest)
+		json.Unmarshal(c.Body(), response)
+		return controller.VerifyProviderToken(c, DB, c.Params("provider"), response.Token)
 	})
 
 	app.Post("/refresh", func(c *fiber.Ctx) error {
@@ -204,33 +334,305 @@ func main() {
 		return controller.RefreshToken(c, DB, refreshToken.RefreshToken)
 	})
 
+	app.Post("/logout", func(c *fiber.Ctx) error {
+		return controller.Logout(c, DB)
+	})
+
+	app.Get("/sessions", func(c *fiber.Ctx) error {
+		return controller.ListSessions(c, DB)
+	})
+
+	app.Delete("/sessions", func(c *fiber.Ctx) error {
+		return controller.RevokeOtherSessions(c, DB)
+	})
+
+	app.Delete("/sessions/:id", func(c *fiber.Ctx) error {
+		return controller.RevokeSession(c, DB)
+	})
+
+	// Called by a signed in phone that scanned a desktop's QR code
+	app.Get("/qr-login/:token", func(c *fiber.Ctx) error {
+		return controller.GetQRLogin(c, redisStore)
+	})
+
+	app.Post("/qr-login/:token/approve", func(c *fiber.Ctx) error {
+		return controller.ApproveQRLogin(c, DB, redisStore)
+	})
+
+	app.Post("/qr-login/:token/deny", func(c *fiber.Ctx) error {
+		return controller.DenyQRLogin(c, redisStore)
+	})
+
+	app.Get("/identities", func(c *fiber.Ctx) error {
+		return controller.ListIdentities(c, DB)
+	})
+
+	app.Post("/identities/:provider/link", func(c *fiber.Ctx) error {
+		return controller.LinkIdentity(c, redisStore)
+	})
+
+	app.Delete("/identities/:id", func(c *fiber.Ctx) error {
+		return controller.UnlinkIdentity(c, DB)
+	})
+
 	app.Post("/nebula/sign-public-key", func(c *fiber.Ctx) error {
-		body := struct {
-			PublicKey string `json:"public_key"`
-			DeviceId  string `json:"device_id"`
-		}{}
-		if err := c.BodyParser(&body); err != nil {
+		body := new(structs.SignPublicKeyRequest)
+		if err := c.BodyParser(body); err != nil {
 			return c.Status(400).JSON(fiber.Map{
 				"error": "Invalid request body",
 			})
 		}
 
+		userId, _ := controller.GetFromToken(c, "ID")
 		// TODO, get last public ip
-		signedKey, caCert, incomingSite, err := controller.SignPublicKey(body.PublicKey, body.DeviceId, DB)
+		signed, err := controller.SignPublicKey(body.PublicKey, body.DeviceId, userId, DB)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Device not found",
+			})
+		}
+		return signedCertResponse(c, signed, err)
+	})
+
+	app.Post("/devices/:id/renew", func(c *fiber.Ctx) error {
+		body := new(structs.SignPublicKeyRequest)
+		if err := c.BodyParser(body); err != nil || body.PublicKey == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		userId, _ := controller.GetFromToken(c, "ID")
+		device := new(structs.Device)
+		if err := DB.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(device).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Device not found",
+			})
+		}
+
+		signed, err := controller.SignDeviceCertificate(body.PublicKey, *device, DB)
+		return signedCertResponse(c, signed, err)
+	})
+
+	app.Get("/nebula/blocklist", func(c *fiber.Ctx) error {
+		blocklist, err := controller.Blocklist(DB)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"blocklist": blocklist,
+		})
+	})
+
+	app.Post("/nebula/revoke", func(c *fiber.Ctx) error {
+		body := new(structs.RevokeRequest)
+		if err := c.BodyParser(body); err != nil || body.Fingerprint == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+
+		userId, _ := controller.GetFromToken(c, "ID")
+		err := controller.RevokeCertificate(DB, redisStore, userId.(string), body.Fingerprint, body.Reason)
+		if errors.Is(err, controller.ErrCertificateNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Certificate not found",
+			})
+		}
 		if err != nil {
 			log.Println(err)
-			return c.Status(500).JSON(fiber.Map{
-				"error": "Failed to sign public key",
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to revoke certificate",
+			})
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	app.Post("/devices/:id/revoke", func(c *fiber.Ctx) error {
+		body := new(structs.RevokeRequest)
+		c.BodyParser(body)
+
+		userId, _ := controller.GetFromToken(c, "ID")
+		device := new(structs.Device)
+		if err := DB.Where("id = ? AND user_id = ?", c.Params("id"), userId).First(device).Error; err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Device not found",
 			})
 		}
 
+		fingerprints, err := controller.RevokeDeviceCertificates(DB, redisStore, device.ID, body.Reason)
+		if err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to revoke certificates",
+			})
+		}
 		return c.JSON(fiber.Map{
-			"signed_key":    signedKey,
-			"ca_cert":       caCert,
-			"incoming_site": incomingSite,
+			"revoked": fingerprints,
 		})
 	})
 
+	app.Post("/devices/:id/approve", func(c *fiber.Ctx) error {
+		return controller.ApproveDevice(c, DB, redisStore)
+	})
+
+	app.Post("/devices/:id/reject", func(c *fiber.Ctx) error {
+		return controller.RejectDevice(c, DB, redisStore)
+	})
+
+	app.Get("/devices/:id/firewall", func(c *fiber.Ctx) error {
+		return controller.DeviceFirewall(c, DB)
+	})
+
+	adminOnly := middlewares.NewRoleMiddleware(middlewares.RoleAdmin)
+
+	admin := app.Group("/admin", adminOnly)
+
+	admin.Get("/users", func(c *fiber.Ctx) error {
+		return controller.AdminListUsers(c, DB)
+	})
+
+	admin.Get("/users/:id", func(c *fiber.Ctx) error {
+		return controller.AdminGetUser(c, DB, redisStore)
+	})
+
+	admin.Patch("/users/:id", func(c *fiber.Ctx) error {
+		return controller.AdminUpdateUser(c, DB)
+	})
+
+	admin.Post("/users/:id/suspend", func(c *fiber.Ctx) error {
+		return controller.AdminSuspendUser(c, DB, redisStore)
+	})
+
+	admin.Post("/users/:id/unsuspend", func(c *fiber.Ctx) error {
+		return controller.AdminUnsuspendUser(c, DB)
+	})
+
+	admin.Get("/devices", func(c *fiber.Ctx) error {
+		return controller.AdminListDevices(c, DB, redisStore)
+	})
+
+	admin.Get("/devices/:id", func(c *fiber.Ctx) error {
+		return controller.AdminGetDevice(c, DB, redisStore)
+	})
+
+	admin.Delete("/devices/:id", func(c *fiber.Ctx) error {
+		return controller.AdminDeleteDevice(c, DB, redisStore)
+	})
+
+	admin.Post("/devices/:id/revoke", func(c *fiber.Ctx) error {
+		return controller.AdminRevokeDevice(c, DB, redisStore)
+	})
+
+	admin.Get("/jwt/keys", func(c *fiber.Ctx) error {
+		return controller.ListJWTKeys(c, DB)
+	})
+
+	admin.Post("/jwt/rotate", func(c *fiber.Ctx) error {
+		key, err := controller.RotateJWTKey(DB)
+		if err != nil {
+			log.Println("Failed to rotate signing key:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to rotate signing key",
+			})
+		}
+		return c.JSON(key)
+	})
+
+	admin.Get("/ipam", func(c *fiber.Ctx) error {
+		return controller.AdminIPPool(c, DB)
+	})
+
+	admin.Get("/ipam/allocations", func(c *fiber.Ctx) error {
+		return controller.AdminIPAllocations(c, DB)
+	})
+
+	// Nebula groups and firewall policy are managed by admins only
+	policy := app.Group("/nebula/policy", adminOnly)
+
+	policy.Get("/groups", func(c *fiber.Ctx) error {
+		return controller.ListGroupAssignments(c, DB)
+	})
+
+	policy.Post("/groups", func(c *fiber.Ctx) error {
+		return controller.CreateGroupAssignment(c, DB)
+	})
+
+	policy.Delete("/groups/:id", func(c *fiber.Ctx) error {
+		return controller.DeleteGroupAssignment(c, DB)
+	})
+
+	policy.Get("/firewall-rules", func(c *fiber.Ctx) error {
+		return controller.ListFirewallRules(c, DB)
+	})
+
+	policy.Post("/firewall-rules", func(c *fiber.Ctx) error {
+		return controller.CreateFirewallRule(c, DB)
+	})
+
+	policy.Delete("/firewall-rules/:id", func(c *fiber.Ctx) error {
+		return controller.DeleteFirewallRule(c, DB)
+	})
+
+	ca := app.Group("/nebula/ca", adminOnly)
+
+	ca.Get("/", func(c *fiber.Ctx) error {
+		cas, err := controller.ListCAs(DB)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		return c.JSON(cas)
+	})
+
+	ca.Post("/rotate", func(c *fiber.Ctx) error {
+		body := new(structs.RotateCARequest)
+		c.BodyParser(body)
+		overlap := 7 * 24 * time.Hour
+		if body.Overlap != "" {
+			var err error
+			overlap, err = time.ParseDuration(body.Overlap)
+			if err != nil || overlap <= 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid overlap duration",
+				})
+			}
+		}
+
+		newCA, err := controller.RotateCA(DB, overlap)
+		if errors.Is(err, controller.ErrRotationInProgress) || errors.Is(err, controller.ErrKeyStoreReadOnly) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to rotate CA",
+			})
+		}
+		return c.JSON(newCA)
+	})
+
+	ca.Post("/:fingerprint/retire", func(c *fiber.Ctx) error {
+		err := controller.RetireCA(DB, c.Params("fingerprint"))
+		if errors.Is(err, controller.ErrCANotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No retiring CA with that fingerprint",
+			})
+		}
+		if err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to retire CA",
+			})
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
 	app.Post("/device/send/:id", func(c *fiber.Ctx) error {
 		deviceId := c.Params("id")
 		userId, _ := controller.GetFromToken(c, "ID")
@@ -242,19 +644,139 @@ func main() {
 		SSEResponse.Type = SSERequest.Type
 		SSEResponse.Data = SSERequest.Data
 		SSEResponse.Device = *device
-		jsonData, _ := json.Marshal(SSEResponse)
 		log.Println("Device ID: ", deviceId, "User Id:", userId)
-		redisStore.Publish(context.Background(), deviceId, jsonData)
-		return c.SendStatus(fiber.StatusOK)
+		allowed, peer, err := controller.CanSendToDevice(DB, userId, deviceId)
+		if err != nil || !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Not allowed to send to this device",
+			})
+		}
+		if peer {
+			SSEResponse.Device = controller.PeerView(*device)
+		}
+		// Receipts go back to the sending device when it is one of the user's
+		senderId := ""
+		if device.ID != uuid.Nil {
+			senderId = device.ID.String()
+		}
+		if err := controller.RelayMessage(context.Background(), redisStore, senderId, deviceId, SSEResponse); err != nil {
+			log.Println("Error queueing message:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to queue message",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"id": SSEResponse.ID,
+		})
+	})
+
+	app.Get("/contacts", func(c *fiber.Ctx) error {
+		return controller.ListContacts(c, DB)
+	})
+
+	app.Post("/contacts", func(c *fiber.Ctx) error {
+		return controller.InviteContact(c, DB, redisStore)
+	})
+
+	app.Post("/contacts/:id/accept", func(c *fiber.Ctx) error {
+		return controller.AcceptContact(c, DB, redisStore)
+	})
+
+	app.Post("/contacts/:id/reject", func(c *fiber.Ctx) error {
+		return controller.RejectContact(c, DB, redisStore)
+	})
+
+	app.Post("/contacts/:id/block", func(c *fiber.Ctx) error {
+		return controller.BlockContact(c, DB, redisStore)
+	})
+
+	app.Delete("/contacts/:id", func(c *fiber.Ctx) error {
+		return controller.DeleteContact(c, DB, redisStore)
+	})
+
+	app.Get("/contacts/:id/devices", func(c *fiber.Ctx) error {
+		return controller.ContactDevices(c, DB, redisStore)
+	})
+
+	app.Post("/organization", func(c *fiber.Ctx) error {
+		return controller.CreateOrganization(c, DB)
+	})
+
+	// Answering an invite needs no membership, so these go before the group's role check
+	app.Get("/organization/invite", func(c *fiber.Ctx) error {
+		return controller.GetOrganizationInvite(c, DB)
+	})
+
+	app.Post("/organization/invite/accept", func(c *fiber.Ctx) error {
+		return controller.AcceptOrganizationInvite(c, DB, redisStore)
+	})
+
+	app.Post("/organization/invite/reject", func(c *fiber.Ctx) error {
+		return controller.RejectOrganizationInvite(c, DB)
+	})
+
+	org := app.Group("/organization", controller.OrgRoleRequired(DB, controller.OrgRoleMember))
+
+	org.Get("/", func(c *fiber.Ctx) error {
+		return controller.GetOrganization(c, DB)
+	})
+
+	org.Patch("/", controller.OrgRoleRequired(DB, controller.OrgRoleAdmin), func(c *fiber.Ctx) error {
+		return controller.UpdateOrganization(c, DB)
+	})
+
+	org.Delete("/", controller.OrgRoleRequired(DB, controller.OrgRoleOwner), func(c *fiber.Ctx) error {
+		return controller.DeleteOrganization(c, DB, redisStore)
+	})
+
+	org.Post("/members", controller.OrgRoleRequired(DB, controller.OrgRoleAdmin), func(c *fiber.Ctx) error {
+		return controller.AddOrganizationMember(c, DB, redisStore)
+	})
+
+	org.Patch("/members/:userId", controller.OrgRoleRequired(DB, controller.OrgRoleAdmin), func(c *fiber.Ctx) error {
+		return controller.UpdateOrganizationMember(c, DB)
+	})
+
+	// Members can remove themselves, admins anyone up to their own role
+	org.Delete("/members/:userId", func(c *fiber.Ctx) error {
+		return controller.RemoveOrganizationMember(c, DB, redisStore)
+	})
+
+	org.Get("/devices", func(c *fiber.Ctx) error {
+		return controller.ListOrganizationDevices(c, DB, redisStore)
+	})
+
+	orgAdmin := org.Group("/admin", controller.OrgRoleRequired(DB, controller.OrgRoleAdmin))
+
+	orgAdmin.Get("/devices", func(c *fiber.Ctx) error {
+		return controller.ListOrganizationDevicesAdmin(c, DB, redisStore)
+	})
+
+	orgAdmin.Delete("/devices/:id", func(c *fiber.Ctx) error {
+		return controller.DeleteOrganizationDevice(c, DB, redisStore)
+	})
+
+	app.Get("/devices/:id/messages", func(c *fiber.Ctx) error {
+		return controller.DeviceMessages(c, DB, redisStore)
+	})
+
+	app.Post("/devices/:id/messages/ack", func(c *fiber.Ctx) error {
+		return controller.AckDeviceMessage(c, DB, redisStore)
+	})
+
+	app.Post("/devices/:id/receive-url", func(c *fiber.Ctx) error {
+		return controller.ReceiveURL(c, DB)
 	})
 
 	app.Get("/device/receive/:id", func(c *fiber.Ctx) error {
 		deviceId := c.Params("id")
 		log.Println("Device ID: ", deviceId)
-		return controller.DeviceSSE(c, redisStore, deviceId)
+		return controller.DeviceSSE(c, DB, redisStore, deviceId)
 	})
 
 	cfg := websocket.Config{
+		// Echoed back to clients that pass their token as a subprotocol
+		Subprotocols: []string{middlewares.StreamAuthSubprotocol},
 		RecoverHandler: func(conn *websocket.Conn) {
 			if err := recover(); err != nil {
 				conn.WriteJSON(fiber.Map{"customError": "error occurred"})
@@ -270,20 +792,50 @@ func main() {
 				log.Println("Error closing connection:", err)
 			}
 		}()
-		// Start a ping-pong loop to keep the connection alive
+		device, err := controller.StreamDevice(c, DB)
+		if err != nil {
+			log.Println("Error reading device info:", err)
+			return
+		}
+
+		ctx := context.Background()
+		if err := controller.MarkConnected(ctx, DB, redisStore, device); err != nil {
+			log.Println("Error updating presence:", err)
+		}
+
+		// Start a ping-pong loop to keep the connection alive, every ping also refreshes presence
+		done := make(chan struct{})
+		stopped := make(chan struct{})
 		go func() {
-			ticker := time.NewTicker(15 * time.Second) // Adjust interval as needed
+			defer close(stopped)
+			ticker := time.NewTicker(controller.PresenceHeartbeatInterval)
 			defer ticker.Stop()
 
-			for range ticker.C {
-				if err := c.WriteMessage(websocket.PingMessage, nil); err != nil {
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				// WriteControl is safe to call alongside the writes in controller.Stream
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
 					log.Println("Error sending ping:", err)
 					return
 				}
+				if err := controller.MarkOnline(ctx, DB, redisStore, device); err != nil {
+					log.Println("Error updating presence:", err)
+				}
 			}
 		}()
 
-		controller.Stream(c, redisStore)
+		controller.Stream(c, DB, device, redisStore)
+
+		// Stop the heartbeats first so they can't mark the device online again
+		close(done)
+		<-stopped
+		if err := controller.MarkOffline(ctx, DB, redisStore, device); err != nil {
+			log.Println("Error updating presence:", err)
+		}
 	}, cfg))
 
 	app.Get("/proxy/:baseUrl", func(c *fiber.Ctx) error {
@@ -307,3 +859,26 @@ func main() {
 
 	log.Fatal(app.Listen(":" + os.Getenv("PORT")))
 }
+
+func signedCertResponse(c *fiber.Ctx, signed structs.SignedCertResponse, err error) error {
+	if errors.Is(err, controller.ErrDeviceNotApproved) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Device has not been approved",
+		})
+	}
+	var exhausted *controller.IPPoolExhaustedError
+	if errors.As(err, &exhausted) {
+		log.Println(err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "No overlay IP addresses available",
+		})
+	}
+	if err != nil {
+		log.Println(err)
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to sign public key",
+		})
+	}
+
+	return c.JSON(signed)
+}
@@ -1,18 +1,85 @@
 package middlewares
 
 import (
+	"strings"
 
 	jwtware "github.com/gofiber/contrib/jwt"
 	"github.com/gofiber/fiber/v2"
-	
+	jtoken "github.com/golang-jwt/jwt/v5"
 )
 
-// Middleware JWT function
-func NewAuthMiddleware(secret string) fiber.Handler {
+// Subprotocol websocket clients offer alongside their token, e.g. "bearer, <token>"
+const StreamAuthSubprotocol = "bearer"
+
+// Roles carried in the token's role claim
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// Middleware JWT function, keyFunc picks the key a token is verified with from its header
+func NewAuthMiddleware(keyFunc jtoken.Keyfunc) fiber.Handler {
 
 	return jwtware.New(jwtware.Config{
-		SigningKey: jwtware.SigningKey{Key: []byte(secret)},
+		KeyFunc: keyFunc,
 	})
 }
 
+// NewRoleMiddleware only lets through tokens carrying one of the given roles. It has to run after
+// NewAuthMiddleware, which leaves the verified token in c.Locals("user").
+func NewRoleMiddleware(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !HasRole(c, roles...) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Insufficient permissions",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// HasRole reports whether the request's verified token carries one of the given roles
+func HasRole(c *fiber.Ctx, roles ...string) bool {
+	token, ok := c.Locals("user").(*jtoken.Token)
+	if !ok {
+		return false
+	}
+	claims, ok := token.Claims.(jtoken.MapClaims)
+	if !ok {
+		return false
+	}
+	role, _ := claims["role"].(string)
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// NewStreamAuthMiddleware authenticates websocket handshakes, which can't set an Authorization
+// header from a browser. The token is taken from the token query param or the
+// Sec-WebSocket-Protocol header and checked like any other request.
+func NewStreamAuthMiddleware(keyFunc jtoken.Keyfunc) fiber.Handler {
+	auth := NewAuthMiddleware(keyFunc)
+	return func(c *fiber.Ctx) error {
+		if token := streamToken(c); token != "" {
+			c.Request().Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		}
+		return auth(c)
+	}
+}
 
+func streamToken(c *fiber.Ctx) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+
+	protocols := strings.Split(c.Get(fiber.HeaderSecWebSocketProtocol), ",")
+	for i, protocol := range protocols {
+		if strings.TrimSpace(protocol) == StreamAuthSubprotocol && i+1 < len(protocols) {
+			return strings.TrimSpace(protocols[i+1])
+		}
+	}
+	return ""
+}
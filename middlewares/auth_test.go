@@ -0,0 +1,93 @@
+package middlewares
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	jtoken "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// hmacKeyfunc verifies HS256 test tokens signed with secret
+func hmacKeyfunc(secret string) jtoken.Keyfunc {
+	return func(token *jtoken.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}
+}
+
+// TestStreamAuthMiddleware tests that the websocket token is read from the query or the subprotocol
+func TestStreamAuthMiddleware(t *testing.T) {
+	secret := "test-secret"
+	token, err := jtoken.NewWithClaims(jtoken.SigningMethodHS256, jtoken.MapClaims{
+		"ID":  "c0ffee00-0000-0000-0000-000000000000",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(secret))
+	assert.NoError(t, err)
+
+	app := fiber.New()
+	app.Get("/stream", NewStreamAuthMiddleware(hmacKeyfunc(secret)), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		target   string
+		protocol string
+		want     int
+	}{
+		{name: "query param", target: "/stream?token=" + token, want: fiber.StatusOK},
+		{name: "subprotocol", target: "/stream", protocol: "bearer, " + token, want: fiber.StatusOK},
+		{name: "no token", target: "/stream", want: fiber.StatusBadRequest},
+		{name: "bad token", target: "/stream?token=nope", want: fiber.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.protocol != "" {
+				req.Header.Set(fiber.HeaderSecWebSocketProtocol, tt.protocol)
+			}
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+}
+
+// TestRoleMiddleware tests that only tokens with an allowed role claim get through
+func TestRoleMiddleware(t *testing.T) {
+	secret := "test-secret"
+	sign := func(claims jtoken.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := jtoken.NewWithClaims(jtoken.SigningMethodHS256, claims).SignedString([]byte(secret))
+		assert.NoError(t, err)
+		return token
+	}
+
+	app := fiber.New()
+	app.Get("/admin", NewAuthMiddleware(hmacKeyfunc(secret)), NewRoleMiddleware(RoleAdmin), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{name: "admin", token: sign(jtoken.MapClaims{"role": RoleAdmin}), want: fiber.StatusOK},
+		{name: "user", token: sign(jtoken.MapClaims{"role": RoleUser}), want: fiber.StatusForbidden},
+		{name: "no role claim", token: sign(jtoken.MapClaims{}), want: fiber.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin", nil)
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tt.token)
+			resp, err := app.Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+}
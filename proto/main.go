@@ -1,14 +1,19 @@
 package proto
 
 import (
+	"context"
+	"encoding/json"
 	"log"
 	"net"
+	"time"
+	"zeroshare-backend/controllers"
 	pb "zeroshare-backend/proto/sse"
 	"zeroshare-backend/structs"
 
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"gorm.io/gorm"
@@ -16,15 +21,32 @@ import (
 
 type server struct {
 	pb.UnimplementedDeviceServiceServer
-	DB  *gorm.DB // Add your DB connection
-	log *zap.Logger
+	DB    *gorm.DB // Add your DB connection
+	Redis *redis.Client
+	log   *zap.Logger
 }
 
 func (s *server) DeviceStream(stream pb.DeviceService_DeviceStreamServer) error {
+	// The device is known once it sends its first request, from then on it is kept online
+	// until the stream closes
+	var online *structs.Device
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(stop)
+		if online == nil {
+			return
+		}
+		<-stopped
+		if err := controllers.MarkOffline(context.Background(), s.DB, s.Redis, *online); err != nil {
+			s.log.Error("Error updating presence:", zap.Error(err))
+		}
+	}()
+
 	for {
 		req, err := stream.Recv()
 		if err != nil {
-			s.log.Fatal("Error receiving request:", zap.Error(err))
+			s.log.Info("Stream closed:", zap.Error(err))
 			return err
 		}
 
@@ -43,6 +65,26 @@ func (s *server) DeviceStream(stream pb.DeviceService_DeviceStreamServer) error
 			return result.Error
 		}
 
+		if online == nil {
+			online = device
+			if err := controllers.MarkConnected(context.Background(), s.DB, s.Redis, *device); err != nil {
+				s.log.Error("Error updating presence:", zap.Error(err))
+			}
+			go s.heartbeat(*device, stop, stopped)
+		}
+
+		// Acks turn into receipts for the message's sender, they aren't echoed back
+		if req.Type == "ack" {
+			data, err := json.Marshal(dataMap)
+			if err == nil {
+				err = controllers.AckMessage(stream.Context(), s.Redis, *device, data)
+			}
+			if err != nil {
+				s.log.Error("Error handling ack:", zap.Error(err))
+			}
+			continue
+		}
+
 		// Business logic: process the request
 		response := &pb.SSEResponse{
 			Type: req.Type,
@@ -67,7 +109,25 @@ func (s *server) DeviceStream(stream pb.DeviceService_DeviceStreamServer) error
 	}
 }
 
-func StartGRPCServer(db *gorm.DB) {
+// heartbeat keeps a streaming device's presence fresh until stop is closed
+func (s *server) heartbeat(device structs.Device, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(controllers.PresenceHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := controllers.MarkOnline(context.Background(), s.DB, s.Redis, device); err != nil {
+			s.log.Error("Error updating presence:", zap.Error(err))
+		}
+	}
+}
+
+func StartGRPCServer(db *gorm.DB, redisStore *redis.Client) {
 	listener, err := net.Listen("tcp", ":50051")
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
@@ -97,7 +157,7 @@ func StartGRPCServer(db *gorm.DB) {
 		),
 		grpc.StreamInterceptor(StreamAuthInterceptor()), // Register streaming interceptor
 	)
-	pb.RegisterDeviceServiceServer(grpcServer, &server{DB: db, log: zapLogger})
+	pb.RegisterDeviceServiceServer(grpcServer, &server{DB: db, Redis: redisStore, log: zapLogger})
 
 	if err := grpcServer.Serve(listener); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -71,8 +72,26 @@ func main() {
 
 			// Get user input using the new function
 			orgName := readInput("Enter Organization Name: ")
-			clientID := readInput("Enter Google Client ID: ")
-			clientSecret := readInput("Enter Google Client Secret: ")
+			// Google sign in is optional, users can always sign in with a code sent by email
+			clientID := readInput("Enter Google Client ID (leave empty to only sign in by email): ")
+			clientSecret := ""
+			if clientID != "" {
+				clientSecret = readInput("Enter Google Client Secret: ")
+			}
+			smtpHost := readInput("Enter SMTP Host for sign in emails (leave empty to write them to the backend log): ")
+			var smtpPort, smtpUsername, smtpPassword, smtpFrom string
+			if smtpHost != "" {
+				smtpPort = readInput("Enter SMTP Port (587): ")
+				smtpUsername = readInput("Enter SMTP Username: ")
+				smtpPassword = readInput("Enter SMTP Password: ")
+				smtpFrom = readInput("Enter Sender Address (e.g. zeroshare@example.com): ")
+			}
+			lighthouseHost := readInput("Enter Lighthouse Public Hostname (e.g. lighthouse.example.com): ")
+			// Checked before anything is written, clients can't reach a lighthouse without a host
+			networkConfig, err := generateNetworkConfig(lighthouseHost)
+			if err != nil {
+				return err
+			}
 
 			// Ask about observability
 			enableObservability := strings.ToLower(readInput("Do you want to enable Observability (Logs, Traces & Metrics)? (yes/no): "))
@@ -126,6 +145,8 @@ func main() {
 			uptraceSelfToken := generateAuthSecret(30)
 			uptraceZtToken := generateAuthSecret(30)
 			uptracePassword := generateAuthSecret(12)
+			// Encrypts the Nebula CA key at rest, the backend encrypts the lighthouse generated key on first start
+			caPassphrase := generateAuthSecret(30)
 			// Get system timezone
 			timezoneName := "UTC" // default fallback
 			if tzData, err := os.ReadFile("/etc/timezone"); err == nil {
@@ -150,7 +171,9 @@ REDIS_PORT=6379
 CLIENT_ID=%s
 CLIENT_SECRET=%s
 REDIRECT_URL=http://localhost:4000/auth/google/callback
-AUTH_SECRET=%s
+PUBLIC_URL=http://localhost:4000
+%sAUTH_SECRET=%s
+NEBULA_CA_PASSPHRASE=%s
 OTEL_METRICS_ENABLED=%s
 OTEL_LOGS_ENABLED=%s
 OTEL_TRACING_ENABLED=%s
@@ -159,14 +182,15 @@ OTEL_EXPORTER_OTLP_HEADERS="uptrace-dsn=http://%s@uptrace:14318?grpc=14317"
 OTEL_EXPORTER_OTLP_COMPRESSION=gzip
 OTEL_EXPORTER_OTLP_METRICS_DEFAULT_HISTOGRAM_AGGREGATION=BASE2_EXPONENTIAL_BUCKET_HISTOGRAM
 OTEL_EXPORTER_OTLP_METRICS_TEMPORALITY_PREFERENCE=DELTA
-NEBULA_CERT_PATH=./bin/nebula-cert
 UPTRACE_SELF_TOKEN=%s
 UPTRACE_ZEROSHARE_TOKEN=%s
 UPTRACE_PASSWORD=%s
 `, timezoneName,
 				clientID,
 				clientSecret,
+				generateMailerEnv(smtpHost, smtpPort, smtpUsername, smtpPassword, smtpFrom),
 				authSecret,
+				caPassphrase,
 				otelMetrics,
 				otelLogs,
 				otelTracing,
@@ -235,6 +259,12 @@ UPTRACE_PASSWORD=%s
 				return fmt.Errorf("failed to write config file: %v", err)
 			}
 
+			// Point clients at this deployment's lighthouse instead of the default one
+			err = os.WriteFile("config/network.yml", []byte(networkConfig), 0644)
+			if err != nil {
+				return fmt.Errorf("failed to write network config file: %v", err)
+			}
+
 			// Run docker compose
 			cmd := exec.Command("docker", "compose", "up", "-d")
 			cmd.Stdout = os.Stdout
@@ -283,6 +313,43 @@ func downloadFile(url, filepath string) error {
 	return os.WriteFile(filepath, content, 0644)
 }
 
+func generateNetworkConfig(lighthouseHost string) (string, error) {
+	lighthouseHost = strings.TrimSpace(lighthouseHost)
+	if _, _, err := net.SplitHostPort(lighthouseHost); err != nil {
+		lighthouseHost = net.JoinHostPort(lighthouseHost, "4242")
+	}
+	host, _, _ := net.SplitHostPort(lighthouseHost)
+	if host == "" {
+		return "", fmt.Errorf("lighthouse hostname is required")
+	}
+
+	return fmt.Sprintf(`cidr: 42.0.0.0/8
+cert_domain: neb.%s
+lighthouses:
+  - ip: 42.0.0.1
+    destinations:
+      - %s
+reserved: []
+`, host, lighthouseHost), nil
+}
+
+// generateMailerEnv configures the SMTP mailer, or the log mailer when no host is given
+func generateMailerEnv(host, port, username, password, from string) string {
+	if host == "" {
+		return "MAILER=log\n"
+	}
+	if port == "" {
+		port = "587"
+	}
+	return fmt.Sprintf(`MAILER=smtp
+SMTP_HOST=%s
+SMTP_PORT=%s
+SMTP_USERNAME=%s
+SMTP_PASSWORD=%s
+SMTP_FROM=%s
+`, host, port, username, password, from)
+}
+
 func updateComposeFile(content string, isOtelEnabled bool) string {
 	var composeConfig map[string]interface{}
 	if err := yaml.Unmarshal([]byte(content), &composeConfig); err != nil {
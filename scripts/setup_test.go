@@ -116,3 +116,65 @@ services:
 		})
 	}
 }
+
+// TestGenerateNetworkConfig tests the generateNetworkConfig function
+func TestGenerateNetworkConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		host        string
+		destination string
+		certDomain  string
+	}{
+		{
+			name:        "hostname without port",
+			host:        "lighthouse.example.com",
+			destination: "lighthouse.example.com:4242",
+			certDomain:  "neb.lighthouse.example.com",
+		},
+		{
+			name:        "hostname with port",
+			host:        "vpn.example.com:4343",
+			destination: "vpn.example.com:4343",
+			certDomain:  "neb.vpn.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config struct {
+				Cidr        string `yaml:"cidr"`
+				CertDomain  string `yaml:"cert_domain"`
+				Lighthouses []struct {
+					Ip           string   `yaml:"ip"`
+					Destinations []string `yaml:"destinations"`
+				} `yaml:"lighthouses"`
+			}
+			generated, err := generateNetworkConfig(tt.host)
+			assert.NoError(t, err)
+			err = yaml.Unmarshal([]byte(generated), &config)
+			assert.NoError(t, err)
+
+			assert.Equal(t, "42.0.0.0/8", config.Cidr)
+			assert.Equal(t, tt.certDomain, config.CertDomain)
+			assert.Len(t, config.Lighthouses, 1)
+			assert.Equal(t, "42.0.0.1", config.Lighthouses[0].Ip)
+			assert.Equal(t, []string{tt.destination}, config.Lighthouses[0].Destinations)
+		})
+	}
+
+	for _, host := range []string{"", "  ", ":4242"} {
+		_, err := generateNetworkConfig(host)
+		assert.Error(t, err, "empty host %q", host)
+	}
+}
+
+// TestGenerateMailerEnv tests that SMTP settings are written only when a host is given
+func TestGenerateMailerEnv(t *testing.T) {
+	assert.Equal(t, "MAILER=log\n", generateMailerEnv("", "", "", "", ""))
+
+	env := generateMailerEnv("smtp.example.com", "", "user", "pass", "zeroshare@example.com")
+	assert.Contains(t, env, "MAILER=smtp\n")
+	assert.Contains(t, env, "SMTP_HOST=smtp.example.com\n")
+	assert.Contains(t, env, "SMTP_PORT=587\n")
+	assert.Contains(t, env, "SMTP_FROM=zeroshare@example.com\n")
+}
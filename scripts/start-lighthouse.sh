@@ -49,22 +49,16 @@ chmod +x /shared-bin/nebula-cert || {
     exit 1
 }
 
-echo "Checking and generating certificates if needed..."
-if [ ! -f /certs/ca.crt ] || [ ! -f /certs/ca.key ]; then
-    echo "Generating CA certificate..."
-    ./nebula-cert ca -name 'ZeroShare, Inc' -out-crt /certs/ca.crt -out-key /certs/ca.key || {
-        echo "Failed to generate CA certificate"
-        exit 1
-    }
-    
-    echo "Generating lighthouse certificate..."
-    ./nebula-cert sign -name 'lighthouse' -ip '42.0.0.1/8' -groups 'lighthouse' \
-        -out-crt /certs/lighthouse.crt -out-key /certs/lighthouse.key \
-        -ca-crt /certs/ca.crt -ca-key /certs/ca.key || {
-        echo "Failed to generate lighthouse certificate"
-        exit 1
-    }
-fi
+# The backend owns the CA, whichever NEBULA_CA_KEY_BACKEND holds its key, and issues the
+# lighthouse cert from config/network.yml on startup. It only starts once this container is
+# healthy, i.e. nebula-cert has been copied above, so wait for the cert here.
+echo "Waiting for the backend to issue the lighthouse certificate..."
+for i in $(seq 1 120); do
+    if [ -f /certs/ca.crt ] && [ -f /certs/lighthouse.crt ] && [ -f /certs/lighthouse.key ]; then
+        break
+    fi
+    sleep 1
+done
 
 # Verify config file exists
 if [ ! -f /config/config.yml ]; then
@@ -72,8 +66,8 @@ if [ ! -f /config/config.yml ]; then
     exit 1
 fi
 
-# Verify certificates exist before starting
-for cert in "/certs/ca.crt" "/certs/ca.key" "/certs/lighthouse.crt" "/certs/lighthouse.key"; do
+# Verify certificates exist before starting, the CA key is not needed here
+for cert in "/certs/ca.crt" "/certs/lighthouse.crt" "/certs/lighthouse.key"; do
     if [ ! -f "$cert" ]; then
         echo "Error: Required certificate $cert not found"
         exit 1
@@ -81,4 +75,25 @@ for cert in "/certs/ca.crt" "/certs/ca.key" "/certs/lighthouse.crt" "/certs/ligh
 done
 
 echo "Starting Nebula lighthouse..."
-exec ./nebula -config /config/config.yml
\ No newline at end of file
+./nebula -config /config/config.yml &
+NEBULA_PID=$!
+trap 'kill -TERM $NEBULA_PID' TERM INT
+
+# The backend rewrites the blocklist in config.yml and re-signs the lighthouse cert when the CA
+# rotates. Nebula reloads both on SIGHUP, so send one whenever the files change.
+set +x
+files_checksum() {
+    cat /config/config.yml /certs/ca.crt /certs/lighthouse.crt /certs/lighthouse.key 2>/dev/null | md5sum
+}
+last_checksum=$(files_checksum)
+while kill -0 $NEBULA_PID 2>/dev/null; do
+    sleep 5
+    checksum=$(files_checksum)
+    if [ "$checksum" != "$last_checksum" ]; then
+        echo "Config or certificates changed, reloading Nebula..."
+        kill -HUP $NEBULA_PID || true
+        last_checksum=$checksum
+    fi
+done
+
+wait $NEBULA_PID
\ No newline at end of file
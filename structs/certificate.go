@@ -0,0 +1,55 @@
+package structs
+
+import "github.com/google/uuid"
+
+type HostCertificate struct {
+	Fingerprint   string    `gorm:"primaryKey" json:"fingerprint"`
+	Name          string    `gorm:"not null" json:"name"`
+	IpAddress     string    `gorm:"not null" json:"ip_address"`
+	NotBefore     int64     `gorm:"not null" json:"not_before"`
+	NotAfter      int64     `gorm:"not null" json:"not_after"`
+	Created       int64     `gorm:"autoCreateTime" json:"created"`
+	CaFingerprint string    `gorm:"index" json:"ca_fingerprint"`
+	DeviceId      uuid.UUID `gorm:"type:uuid;not null;index" json:"device_id"`
+	Device        Device    `gorm:"foreignKey:DeviceId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+type CertRevocation struct {
+	Fingerprint string     `gorm:"primaryKey" json:"fingerprint"`
+	DeviceId    *uuid.UUID `gorm:"type:uuid;index" json:"device_id"`
+	Reason      string     `json:"reason"`
+	NotAfter    int64      `json:"not_after"`
+	Created     int64      `gorm:"autoCreateTime" json:"created"`
+}
+
+type RevokeRequest struct {
+	Fingerprint string `json:"fingerprint"`
+	Reason      string `json:"reason"`
+}
+
+type SignPublicKeyRequest struct {
+	PublicKey string `json:"public_key"`
+	DeviceId  string `json:"device_id"`
+}
+
+type SignedCertResponse struct {
+	SignedKey    string                 `json:"signed_key"`
+	CaCert       string                 `json:"ca_cert"`
+	IncomingSite map[string]interface{} `json:"incoming_site"`
+	NotAfter     int64                  `json:"not_after"`
+}
+
+type CertificateAuthority struct {
+	Fingerprint string `gorm:"primaryKey" json:"fingerprint"`
+	Name        string `gorm:"not null" json:"name"`
+	Cert        string `gorm:"not null" json:"cert"`
+	Status      string `gorm:"not null;index" json:"status"`
+	NotAfter    int64  `gorm:"not null" json:"not_after"`
+	RetireAt    int64  `json:"retire_at"`
+	Created     int64  `gorm:"autoCreateTime" json:"created"`
+}
+
+type RotateCARequest struct {
+	// How long the old CA stays trusted, e.g. "168h"
+	Overlap string `json:"overlap"`
+}
@@ -0,0 +1,47 @@
+package structs
+
+import "github.com/google/uuid"
+
+// Contact links two users so they can see and message each other's devices once accepted
+type Contact struct {
+	ID          uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	RequesterId uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_contact_pair" json:"requester_id"`
+	AddresseeId uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex:idx_contact_pair;index" json:"addressee_id"`
+	Status      string     `gorm:"not null;index" json:"status"`
+	BlockedBy   *uuid.UUID `gorm:"type:uuid" json:"blocked_by,omitempty"`
+	Created     int64      `gorm:"autoCreateTime" json:"created"`
+	Updated     int64      `gorm:"autoUpdateTime" json:"updated"`
+	Requester   User       `gorm:"foreignKey:RequesterId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+	Addressee   User       `gorm:"foreignKey:AddresseeId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+type ContactInviteRequest struct {
+	Email string `json:"email"`
+}
+
+// ContactResponse is a contact as seen by one side of it
+type ContactResponse struct {
+	ID       uuid.UUID   `json:"id"`
+	Status   string      `json:"status"`
+	Incoming bool        `json:"incoming"`
+	User     ContactUser `json:"user"`
+	Created  int64       `json:"created"`
+}
+
+// ContactUser is the part of a user's profile their contacts can see
+type ContactUser struct {
+	ID      uuid.UUID `json:"id"`
+	Name    string    `json:"name"`
+	Email   string    `json:"email"`
+	Picture string    `json:"picture"`
+}
+
+// SharedDevice is the part of a device its owner's contacts and organization can see
+type SharedDevice struct {
+	ID          uuid.UUID `json:"id"`
+	UserId      uuid.UUID `json:"user_id"`
+	MachineName string    `json:"machine_name"`
+	Platform    string    `json:"platform"`
+	Online      bool      `json:"online"`
+	LastSeen    int64     `json:"last_seen"`
+}
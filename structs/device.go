@@ -10,6 +10,16 @@ type Device struct {
 	IpAddress   string    `gorm:"null" json:"ip_address"`
 	Created     int64     `gorm:"autoCreateTime"`
 	Updated     int64     `gorm:"autoUpdateTime:milli" json:"updated"`
+	Status      string    `gorm:"not null;default:approved" json:"status"`
 	UserId      uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
 	User        User      `gorm:"foreignKey:UserId;references:ID"`
+	// Presence comes from Redis, see controllers/presence.go
+	Online   bool  `gorm:"-" json:"online"`
+	LastSeen int64 `gorm:"-" json:"last_seen"`
+}
+
+// UpdateDeviceRequest only changes the fields that are set
+type UpdateDeviceRequest struct {
+	MachineName *string `json:"machine_name"`
+	Platform    *string `json:"platform"`
 }
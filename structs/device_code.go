@@ -0,0 +1,24 @@
+package structs
+
+// DeviceAuthorizationResponse starts an RFC 8628 device authorization grant
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type UserCodeRequest struct {
+	UserCode string `json:"user_code"`
+}
+
+// DeviceCodeInfo lets the approving user check which client they are signing in
+type DeviceCodeInfo struct {
+	UserCode  string `json:"user_code"`
+	ClientId  string `json:"client_id"`
+	UserAgent string `json:"user_agent"`
+	IpAddress string `json:"ip_address"`
+	ExpiresAt int64  `json:"expires_at"`
+}
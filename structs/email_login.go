@@ -0,0 +1,12 @@
+package structs
+
+type EmailLoginRequest struct {
+	Email string `json:"email"`
+	// Issued by /login/session, the app waits on it at /sse/:sessionToken
+	SessionToken string `json:"session_token"`
+}
+
+type EmailCodeRequest struct {
+	SessionToken string `json:"session_token"`
+	Code         string `json:"code"`
+}
@@ -0,0 +1,31 @@
+package structs
+
+import "github.com/google/uuid"
+
+// Identity links a user to an account at an identity provider, a user can have several
+type Identity struct {
+	ID       uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	UserId   uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	Provider string    `gorm:"not null;uniqueIndex:idx_identity_subject" json:"provider"`
+	Subject  string    `gorm:"not null;uniqueIndex:idx_identity_subject" json:"subject"`
+	Email    string    `json:"email"`
+	Created  int64     `gorm:"autoCreateTime" json:"created"`
+	LastUsed int64     `json:"last_used"`
+	User     User      `gorm:"foreignKey:UserId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// ProviderProfile is what an identity provider tells us about the user who signed in
+type ProviderProfile struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	GivenName     string
+	FamilyName    string
+	Picture       string
+	Locale        string
+}
+
+type ProviderTokenRequest struct {
+	Token string `json:"token"`
+}
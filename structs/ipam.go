@@ -0,0 +1,42 @@
+package structs
+
+import "github.com/google/uuid"
+
+type IpAllocation struct {
+	IpInt     int64     `gorm:"primaryKey;autoIncrement:false" json:"-"`
+	IpAddress string    `gorm:"unique;not null" json:"ip_address"`
+	DeviceId  uuid.UUID `gorm:"type:uuid;unique;not null" json:"device_id"`
+	Created   int64     `gorm:"autoCreateTime" json:"created"`
+	Device    Device    `gorm:"foreignKey:DeviceId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+type IpReservation struct {
+	ID      uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	StartIp int64     `gorm:"not null;uniqueIndex:idx_ip_reservation_range" json:"-"`
+	EndIp   int64     `gorm:"not null;uniqueIndex:idx_ip_reservation_range" json:"-"`
+	Start   string    `gorm:"not null" json:"start"`
+	End     string    `gorm:"not null" json:"end"`
+	Reason  string    `json:"reason"`
+	Created int64     `gorm:"autoCreateTime" json:"created"`
+}
+
+// IpPoolStatus sums up the overlay network's address pool
+type IpPoolStatus struct {
+	Network      string          `json:"network"`
+	First        string          `json:"first"`
+	Last         string          `json:"last"`
+	Size         int64           `json:"size"`
+	Allocated    int64           `json:"allocated"`
+	Reserved     int64           `json:"reserved"`
+	Free         int64           `json:"free"`
+	Reservations []IpReservation `json:"reservations"`
+}
+
+// IpAllocationResponse is an allocated address with the device holding it
+type IpAllocationResponse struct {
+	IpAddress   string    `json:"ip_address"`
+	DeviceId    uuid.UUID `json:"device_id"`
+	MachineName string    `json:"machine_name"`
+	UserId      uuid.UUID `json:"user_id"`
+	Created     int64     `json:"created"`
+}
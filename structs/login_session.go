@@ -0,0 +1,12 @@
+package structs
+
+// LoginSessionRequest carries the PKCE challenge, RFC 7636, for the verifier only the client knows
+type LoginSessionRequest struct {
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+type LoginSessionResponse struct {
+	SessionToken string `json:"session_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
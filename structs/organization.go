@@ -0,0 +1,55 @@
+package structs
+
+import "github.com/google/uuid"
+
+type Organization struct {
+	ID      uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	Name    string    `gorm:"not null" json:"name"`
+	Created int64     `gorm:"autoCreateTime" json:"created"`
+	Updated int64     `gorm:"autoUpdateTime" json:"updated"`
+}
+
+// OrganizationMember puts a user in an organization. A user is in at most one organization.
+// Invited users are pending until they accept, only accepted members get any access.
+type OrganizationMember struct {
+	ID             uuid.UUID    `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	OrganizationId uuid.UUID    `gorm:"type:uuid;not null;index" json:"organization_id"`
+	UserId         uuid.UUID    `gorm:"type:uuid;not null;uniqueIndex" json:"user_id"`
+	Role           string       `gorm:"not null" json:"role"`
+	Status         string       `gorm:"not null;default:accepted;index" json:"status"`
+	Created        int64        `gorm:"autoCreateTime" json:"created"`
+	Organization   Organization `gorm:"foreignKey:OrganizationId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+	User           User         `gorm:"foreignKey:UserId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+type OrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+type OrganizationMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type OrganizationResponse struct {
+	Organization
+	Role    string                       `json:"role"`
+	Members []OrganizationMemberResponse `json:"members"`
+}
+
+type OrganizationMemberResponse struct {
+	UserId  uuid.UUID `json:"user_id"`
+	Name    string    `json:"name"`
+	Email   string    `json:"email"`
+	Picture string    `json:"picture"`
+	Role    string    `json:"role"`
+	Status  string    `json:"status"`
+	Created int64     `json:"created"`
+}
+
+// OrganizationInviteResponse is a pending invite as seen by the invited user
+type OrganizationInviteResponse struct {
+	Organization Organization `json:"organization"`
+	Role         string       `json:"role"`
+	Created      int64        `json:"created"`
+}
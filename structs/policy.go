@@ -0,0 +1,25 @@
+package structs
+
+import "github.com/google/uuid"
+
+// GroupAssignment puts every device of a user, or a single device, into a Nebula group
+type GroupAssignment struct {
+	ID       uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	Group    string     `gorm:"column:group_name;not null;index" json:"group"`
+	UserId   *uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	DeviceId *uuid.UUID `gorm:"type:uuid;index" json:"device_id"`
+	Created  int64      `gorm:"autoCreateTime" json:"created"`
+}
+
+// FirewallRule lets peers matching Group, Host or Cidr into devices carrying TargetGroup
+type FirewallRule struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	TargetGroup string    `gorm:"not null;index" json:"target_group"`
+	Port        string    `gorm:"not null" json:"port"`
+	Proto       string    `gorm:"not null" json:"proto"`
+	Group       string    `gorm:"column:peer_group" json:"group"`
+	Host        string    `json:"host"`
+	Cidr        string    `json:"cidr"`
+	Description string    `json:"description"`
+	Created     int64     `gorm:"autoCreateTime" json:"created"`
+}
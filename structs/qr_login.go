@@ -0,0 +1,16 @@
+package structs
+
+// QRLoginInfo describes the desktop asking to be signed in, for the phone to show before approving
+type QRLoginInfo struct {
+	Name      string `json:"name"`
+	Platform  string `json:"platform"`
+	UserAgent string `json:"user_agent"`
+	IpAddress string `json:"ip_address"`
+	Created   int64  `json:"created"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type QRLoginRequest struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+}
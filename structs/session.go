@@ -0,0 +1,32 @@
+package structs
+
+import "github.com/google/uuid"
+
+// Session is one login of a user. Its refresh tokens form a family, each one is replaced on use.
+type Session struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey" json:"id"`
+	UserId    uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	UserAgent string    `json:"user_agent"`
+	IpAddress string    `json:"ip_address"`
+	Created   int64     `gorm:"autoCreateTime" json:"created"`
+	LastUsed  int64     `json:"last_used"`
+	ExpiresAt int64     `gorm:"not null" json:"expires_at"`
+	RevokedAt *int64    `json:"revoked_at,omitempty"`
+	User      User      `gorm:"foreignKey:UserId;references:ID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// RefreshToken is stored by hash only, the token itself is never kept
+type RefreshToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	SessionId uuid.UUID `gorm:"type:uuid;not null;index"`
+	TokenHash string    `gorm:"not null;uniqueIndex"`
+	ExpiresAt int64     `gorm:"not null"`
+	UsedAt    *int64
+	Created   int64   `gorm:"autoCreateTime"`
+	Session   Session `gorm:"foreignKey:SessionId;references:ID;constraint:OnDelete:CASCADE"`
+}
+
+type SessionResponse struct {
+	Session
+	Current bool `json:"current"`
+}
@@ -0,0 +1,27 @@
+package structs
+
+// SigningKey is a key in the JWT keyring. Only one key signs at a time, retired keys keep
+// verifying tokens until ExpiresAt.
+type SigningKey struct {
+	Kid        string `gorm:"primaryKey" json:"kid"`
+	Algorithm  string `gorm:"not null" json:"alg"`
+	PublicKey  []byte `gorm:"not null" json:"-"`
+	PrivateKey []byte `gorm:"not null" json:"-"`
+	Created    int64  `gorm:"autoCreateTime" json:"created"`
+	RetiredAt  *int64 `json:"retired_at,omitempty"`
+	ExpiresAt  *int64 `json:"expires_at,omitempty"`
+}
+
+// JWK is a public key as published in the JWKS
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
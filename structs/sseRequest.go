@@ -11,7 +11,35 @@ type SSERequest struct {
 }
 
 type SSEResponse struct {
-	Type   string          `json:"type"`
-	Data   json.RawMessage `json:"data"`
-	Device Device          `json:"device"`
+	// Queue ID of the message, devices pass the last one they got to pick up where they left off
+	ID string `json:"id,omitempty"`
+	// Unix millis the backend queued the message at
+	Timestamp int64           `json:"timestamp,omitempty"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	Device    Device          `json:"device"`
+}
+
+// MessageAck is the data of an "ack" frame a device sends for a message it received
+type MessageAck struct {
+	ID string `json:"id"`
+	// "delivered" (default) or "read"
+	Status string `json:"status"`
+}
+
+// MessageReceipt is the data of the "receipt" events sent back to a message's sender
+type MessageReceipt struct {
+	ID        string `json:"id"`
+	DeviceId  string `json:"device_id"`
+	Status    string `json:"status"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// MessageStatus describes a message queued for a device
+type MessageStatus struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	SenderId  string `json:"sender_id,omitempty"`
+	Status    string `json:"status"`
+	Timestamp int64  `json:"timestamp"`
 }
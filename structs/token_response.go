@@ -5,10 +5,6 @@ type TokenResponse struct {
 	RefresToken string `json:"refresh_token"`
 }
 
-type GoogleTokenResponse struct {
-	Token string `json:"token"`
-}
-
 type RefreshTokenRequest struct {
 	RefreshToken string `json:"refresh_token"`
 }
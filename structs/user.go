@@ -2,9 +2,11 @@ package structs
 
 import "github.com/google/uuid"
 
+// User is someone who signed in through one or more identities. GoogleID predates identities and
+// is only read to backfill them.
 type User struct {
 	ID            uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
-	GoogleID      string    `gorm:"unique;not null" json:"id"`
+	GoogleID      *string   `gorm:"unique" json:"id"`
 	Email         string    `gorm:"unique;not null" json:"email"`
 	FamilyName    string    `gorm:"not null" json:"family_name"`
 	GivenName     string    `gorm:"not null" json:"given_name"`
@@ -12,4 +14,10 @@ type User struct {
 	Name          string    `gorm:"not null" json:"name"`
 	Picture       string    `json:"picture"`
 	VerifiedEmail bool      `gorm:"not null" json:"verified_email"`
+	Role          string    `gorm:"not null;default:user" json:"role"`
+	Suspended     bool      `gorm:"not null;default:false" json:"suspended"`
+}
+
+type UpdateUserRequest struct {
+	Role string `json:"role"`
 }